@@ -0,0 +1,318 @@
+package core
+
+import (
+    "archive/tar"
+    "bufio"
+    "bytes"
+    "compress/gzip"
+    "fmt"
+    "io"
+    "io/ioutil"
+    "os"
+    "path"
+    "path/filepath"
+    "strings"
+    "sync"
+)
+
+// imageSource gives read access to the files of a local image, which may be
+// a directory, a tarball or a gzip compressed tarball. Names are slash
+// separated and relative to the image root.
+type imageSource interface {
+    exists(name string) bool
+    open(name string) (io.ReadCloser, int64, error)
+    close() error
+}
+
+// openSource opens a directory or a docker save / OCI layout archive.
+func openSource(file string) (imageSource, error) {
+    stat, err := os.Stat(file)
+    if err != nil {
+        return nil, err
+    }
+    if stat.IsDir() {
+        return &dirSource{root: file}, nil
+    }
+    return openTarSource(file)
+}
+
+func readSourceFile(source imageSource, name string) ([]byte, error) {
+    r, _, err := source.open(name)
+    if err != nil {
+        return nil, err
+    }
+    defer func() {
+        _ = r.Close()
+    }()
+    return ioutil.ReadAll(r)
+}
+
+type dirSource struct {
+    root string
+}
+
+func (s *dirSource) path(name string) string {
+    return filepath.Join(s.root, filepath.FromSlash(name))
+}
+
+func (s *dirSource) exists(name string) bool {
+    _, err := os.Stat(s.path(name))
+    return err == nil
+}
+
+func (s *dirSource) open(name string) (io.ReadCloser, int64, error) {
+    f, err := os.Open(s.path(name))
+    if err != nil {
+        return nil, 0, err
+    }
+    stat, err := f.Stat()
+    if err != nil {
+        _ = f.Close()
+        return nil, 0, err
+    }
+    return f, stat.Size(), nil
+}
+
+func (s *dirSource) close() error {
+    return nil
+}
+
+// tarEntryInfo locates the data of an entry: offset is into the file for
+// plain tarballs and into the decompressed stream for gzip ones.
+type tarEntryInfo struct {
+    offset int64
+    size   int64
+}
+
+// maxIdleCursors bounds the decompressors kept open between reads of a gzip
+// archive.
+const maxIdleCursors = 4
+
+// tarSource reads files out of a tarball without extracting it. The archive
+// is indexed once; entries of plain tarballs are then read in place, while
+// gzip compressed ones are read through cursors, decompressors that only
+// move forward and are kept where the last read left them. Reading entries
+// in archive order decompresses the archive once; a cursor starts over only
+// when every idle one is past the entry.
+type tarSource struct {
+    file       *os.File
+    compressed bool
+    entries    map[string]tarEntryInfo
+    links      map[string]string
+
+    mu      sync.Mutex
+    cursors []*gzipCursor
+}
+
+// gzipCursor decompresses the archive on its own file handle, pos bytes
+// into the decompressed stream.
+type gzipCursor struct {
+    file *os.File
+    gz   *gzip.Reader
+    pos  int64
+    err  error
+}
+
+func (c *gzipCursor) Read(p []byte) (int, error) {
+    n, err := c.gz.Read(p)
+    c.pos += int64(n)
+    if err != nil && err != io.EOF {
+        c.err = err
+    }
+    return n, err
+}
+
+func (c *gzipCursor) close() error {
+    return c.file.Close()
+}
+
+// countingReader counts the bytes read through it.
+type countingReader struct {
+    r io.Reader
+    n int64
+}
+
+func (c *countingReader) Read(p []byte) (int, error) {
+    n, err := c.r.Read(p)
+    c.n += int64(n)
+    return n, err
+}
+
+func openTarSource(file string) (*tarSource, error) {
+    f, err := os.Open(file)
+    if err != nil {
+        return nil, err
+    }
+    s := tarSource{
+        file:    f,
+        entries: map[string]tarEntryInfo{},
+        links:   map[string]string{},
+    }
+    if err := s.index(); err != nil {
+        _ = f.Close()
+        return nil, fmt.Errorf("read archive %s: %v", file, err)
+    }
+    return &s, nil
+}
+
+// index records where the entries are. The tar reader does not read ahead
+// of the entry data, so after Next the bytes consumed so far are the offset
+// of the data.
+func (s *tarSource) index() error {
+    magic := make([]byte, 2)
+    if _, err := io.ReadFull(s.file, magic); err != nil {
+        return err
+    }
+    s.compressed = bytes.Equal(magic, []byte{0x1f, 0x8b})
+    if _, err := s.file.Seek(0, io.SeekStart); err != nil {
+        return err
+    }
+    stream := &countingReader{r: s.file}
+    if s.compressed {
+        gz, err := gzip.NewReader(bufio.NewReader(s.file))
+        if err != nil {
+            return err
+        }
+        stream.r = gz
+    }
+    tr := tar.NewReader(stream)
+    for {
+        header, err := tr.Next()
+        if err == io.EOF {
+            return nil
+        }
+        if err != nil {
+            return err
+        }
+        name := cleanEntryName(header.Name)
+        switch header.Typeflag {
+        case tar.TypeReg, tar.TypeRegA:
+            s.entries[name] = tarEntryInfo{offset: stream.n, size: header.Size}
+        case tar.TypeSymlink:
+            s.links[name] = cleanEntryName(path.Join(path.Dir(name), header.Linkname))
+        case tar.TypeLink:
+            s.links[name] = cleanEntryName(header.Linkname)
+        }
+    }
+}
+
+// resolve follows links, docker save writes legacy layer paths as symlinks
+// into the blobs directory.
+func (s *tarSource) resolve(name string) string {
+    name = cleanEntryName(name)
+    for hops := 0; hops < 16; hops++ {
+        target, ok := s.links[name]
+        if !ok {
+            break
+        }
+        name = target
+    }
+    return name
+}
+
+func (s *tarSource) exists(name string) bool {
+    _, ok := s.entries[s.resolve(name)]
+    return ok
+}
+
+func (s *tarSource) open(name string) (io.ReadCloser, int64, error) {
+    name = s.resolve(name)
+    info, ok := s.entries[name]
+    if !ok {
+        return nil, 0, fmt.Errorf("%s not found in archive %s", name, s.file.Name())
+    }
+    if !s.compressed {
+        return ioutil.NopCloser(io.NewSectionReader(s.file, info.offset, info.size)), info.size, nil
+    }
+    cursor, err := s.cursor(info.offset)
+    if err != nil {
+        return nil, 0, err
+    }
+    if _, err := io.CopyN(ioutil.Discard, cursor, info.offset-cursor.pos); err != nil {
+        _ = cursor.close()
+        return nil, 0, err
+    }
+    return &cursorEntry{Reader: io.LimitReader(cursor, info.size), cursor: cursor, source: s}, info.size, nil
+}
+
+// cursor takes the idle cursor closest before offset, or opens a new one.
+func (s *tarSource) cursor(offset int64) (*gzipCursor, error) {
+    s.mu.Lock()
+    best := -1
+    for index, c := range s.cursors {
+        if c.pos <= offset && (best < 0 || c.pos > s.cursors[best].pos) {
+            best = index
+        }
+    }
+    if best >= 0 {
+        c := s.cursors[best]
+        s.cursors = append(s.cursors[:best], s.cursors[best+1:]...)
+        s.mu.Unlock()
+        return c, nil
+    }
+    s.mu.Unlock()
+    f, err := os.Open(s.file.Name())
+    if err != nil {
+        return nil, err
+    }
+    gz, err := gzip.NewReader(bufio.NewReader(f))
+    if err != nil {
+        _ = f.Close()
+        return nil, err
+    }
+    return &gzipCursor{file: f, gz: gz}, nil
+}
+
+// release keeps c for later reads, dropping the cursor furthest behind when
+// there are too many. Cursors that failed are closed.
+func (s *tarSource) release(c *gzipCursor) {
+    if c.err != nil {
+        _ = c.close()
+        return
+    }
+    s.mu.Lock()
+    defer s.mu.Unlock()
+    s.cursors = append(s.cursors, c)
+    if len(s.cursors) <= maxIdleCursors {
+        return
+    }
+    oldest := 0
+    for index, c := range s.cursors {
+        if c.pos < s.cursors[oldest].pos {
+            oldest = index
+        }
+    }
+    _ = s.cursors[oldest].close()
+    s.cursors = append(s.cursors[:oldest], s.cursors[oldest+1:]...)
+}
+
+func (s *tarSource) close() error {
+    s.mu.Lock()
+    defer s.mu.Unlock()
+    for _, c := range s.cursors {
+        _ = c.close()
+    }
+    s.cursors = nil
+    return s.file.Close()
+}
+
+// cursorEntry reads an entry through a cursor, which goes back to the source
+// on Close.
+type cursorEntry struct {
+    io.Reader
+    cursor *gzipCursor
+    source *tarSource
+    closed bool
+}
+
+func (e *cursorEntry) Close() error {
+    if !e.closed {
+        e.closed = true
+        e.source.release(e.cursor)
+    }
+    return nil
+}
+
+func cleanEntryName(name string) string {
+    return strings.TrimPrefix(path.Clean("/"+name), "/")
+}
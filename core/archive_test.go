@@ -0,0 +1,247 @@
+package core
+
+import (
+    "archive/tar"
+    "compress/gzip"
+    "fmt"
+    "io"
+    "io/ioutil"
+    "os"
+    "path/filepath"
+    "strings"
+    "testing"
+)
+
+// testEntry is a file or, when link is set, a symlink of a test archive.
+type testEntry struct {
+    name     string
+    content  string
+    link     string
+    hardlink bool
+}
+
+func writeTestArchive(t *testing.T, entries []testEntry, compressed bool) string {
+    t.Helper()
+    file := filepath.Join(t.TempDir(), "image.tar")
+    f, err := os.Create(file)
+    if err != nil {
+        t.Fatal(err)
+    }
+    defer func() {
+        _ = f.Close()
+    }()
+    var w io.Writer = f
+    var gz *gzip.Writer
+    if compressed {
+        gz = gzip.NewWriter(f)
+        w = gz
+    }
+    tw := tar.NewWriter(w)
+    for _, entry := range entries {
+        header := &tar.Header{Name: entry.name, Mode: 0644}
+        switch {
+        case entry.link != "" && entry.hardlink:
+            header.Typeflag = tar.TypeLink
+            header.Linkname = entry.link
+        case entry.link != "":
+            header.Typeflag = tar.TypeSymlink
+            header.Linkname = entry.link
+        default:
+            header.Typeflag = tar.TypeReg
+            header.Size = int64(len(entry.content))
+        }
+        if err := tw.WriteHeader(header); err != nil {
+            t.Fatal(err)
+        }
+        if _, err := io.WriteString(tw, entry.content); err != nil {
+            t.Fatal(err)
+        }
+    }
+    if err := tw.Close(); err != nil {
+        t.Fatal(err)
+    }
+    if gz != nil {
+        if err := gz.Close(); err != nil {
+            t.Fatal(err)
+        }
+    }
+    return file
+}
+
+func TestTarSourceReadOrder(t *testing.T) {
+    var entries []testEntry
+    for index := 0; index < 8; index++ {
+        name := fmt.Sprintf("%c", 'a'+index)
+        entries = append(entries, testEntry{
+            name:    name,
+            content: strings.Repeat(name, 4096*(index+1)),
+        })
+    }
+    contents := map[string]string{}
+    for _, entry := range entries {
+        contents[entry.name] = entry.content
+    }
+
+    // each step opens its entries together, reads them and closes them, so
+    // that the entries of a step are read through distinct cursors.
+    tests := []struct {
+        name  string
+        steps [][]string
+    }{
+        {
+            name:  "archive order",
+            steps: [][]string{{"a"}, {"b"}, {"c"}, {"d"}, {"e"}, {"f"}, {"g"}, {"h"}},
+        },
+        {
+            name:  "reverse order",
+            steps: [][]string{{"h"}, {"g"}, {"f"}, {"e"}, {"d"}, {"c"}, {"b"}, {"a"}},
+        },
+        {
+            name:  "entry before every idle cursor",
+            steps: [][]string{{"c", "e", "g"}, {"a"}, {"d"}, {"h"}},
+        },
+        {
+            name:  "more open entries than idle cursors",
+            steps: [][]string{{"b", "c", "d", "e", "f", "g"}, {"a"}, {"h"}, {"a", "b"}},
+        },
+        {
+            name:  "same entry twice",
+            steps: [][]string{{"d"}, {"d"}, {"d", "d"}},
+        },
+    }
+    for _, compressed := range []bool{false, true} {
+        file := writeTestArchive(t, entries, compressed)
+        for _, tt := range tests {
+            t.Run(fmt.Sprintf("%s compressed=%v", tt.name, compressed), func(t *testing.T) {
+                source, err := openTarSource(file)
+                if err != nil {
+                    t.Fatal(err)
+                }
+                defer func() {
+                    _ = source.close()
+                }()
+                if source.compressed != compressed {
+                    t.Fatalf("compressed = %v, want %v", source.compressed, compressed)
+                }
+                for _, step := range tt.steps {
+                    readers := make([]io.ReadCloser, len(step))
+                    for index, name := range step {
+                        r, size, err := source.open(name)
+                        if err != nil {
+                            t.Fatal(err)
+                        }
+                        if size != int64(len(contents[name])) {
+                            t.Errorf("%s: size = %d, want %d", name, size, len(contents[name]))
+                        }
+                        readers[index] = r
+                    }
+                    for index, name := range step {
+                        got, err := ioutil.ReadAll(readers[index])
+                        if err != nil {
+                            t.Fatal(err)
+                        }
+                        if string(got) != contents[name] {
+                            t.Errorf("%s: got %d bytes not matching the entry", name, len(got))
+                        }
+                    }
+                    for _, r := range readers {
+                        if err := r.Close(); err != nil {
+                            t.Fatal(err)
+                        }
+                    }
+                    if len(source.cursors) > maxIdleCursors {
+                        t.Errorf("%d idle cursors, want at most %d", len(source.cursors), maxIdleCursors)
+                    }
+                }
+            })
+        }
+    }
+}
+
+func TestTarSourceCursorReuse(t *testing.T) {
+    entries := []testEntry{
+        {name: "a", content: strings.Repeat("a", 1000)},
+        {name: "b", content: strings.Repeat("b", 1000)},
+        {name: "c", content: strings.Repeat("c", 1000)},
+    }
+    source, err := openTarSource(writeTestArchive(t, entries, true))
+    if err != nil {
+        t.Fatal(err)
+    }
+    defer func() {
+        _ = source.close()
+    }()
+    for _, entry := range entries {
+        r, _, err := source.open(entry.name)
+        if err != nil {
+            t.Fatal(err)
+        }
+        if _, err := ioutil.ReadAll(r); err != nil {
+            t.Fatal(err)
+        }
+        if err := r.Close(); err != nil {
+            t.Fatal(err)
+        }
+        if err := r.Close(); err != nil {
+            t.Fatal(err)
+        }
+        if len(source.cursors) != 1 {
+            t.Fatalf("after %s: %d idle cursors, want 1", entry.name, len(source.cursors))
+        }
+    }
+}
+
+func TestTarSourceLinks(t *testing.T) {
+    layer := "blobs/sha256/5f70bf18a086007016e948b04aed3b82103a36bea41755b6cddfaf10ace3c6ef"
+    entries := []testEntry{
+        {name: layer, content: "layer content"},
+        {name: "abc/layer.tar", link: "../" + layer},
+        {name: "def/layer.tar", link: "../abc/layer.tar"},
+        {name: "ghi/layer.tar", link: layer, hardlink: true},
+        {name: "dangling/layer.tar", link: "../blobs/sha256/missing"},
+        {name: "loop/a", link: "b"},
+        {name: "loop/b", link: "a"},
+    }
+    tests := []struct {
+        name    string
+        path    string
+        content string
+        exists  bool
+    }{
+        {name: "regular file", path: layer, content: "layer content", exists: true},
+        {name: "symlink", path: "abc/layer.tar", content: "layer content", exists: true},
+        {name: "symlink to symlink", path: "def/layer.tar", content: "layer content", exists: true},
+        {name: "hardlink", path: "ghi/layer.tar", content: "layer content", exists: true},
+        {name: "unclean name", path: "./abc//layer.tar", content: "layer content", exists: true},
+        {name: "dangling symlink", path: "dangling/layer.tar"},
+        {name: "symlink loop", path: "loop/a"},
+        {name: "missing", path: "missing/layer.tar"},
+    }
+    for _, compressed := range []bool{false, true} {
+        source, err := openTarSource(writeTestArchive(t, entries, compressed))
+        if err != nil {
+            t.Fatal(err)
+        }
+        for _, tt := range tests {
+            t.Run(fmt.Sprintf("%s compressed=%v", tt.name, compressed), func(t *testing.T) {
+                if got := source.exists(tt.path); got != tt.exists {
+                    t.Fatalf("exists = %v, want %v", got, tt.exists)
+                }
+                got, err := readSourceFile(source, tt.path)
+                if !tt.exists {
+                    if err == nil {
+                        t.Fatal("expected an error")
+                    }
+                    return
+                }
+                if err != nil {
+                    t.Fatal(err)
+                }
+                if string(got) != tt.content {
+                    t.Errorf("content = %q, want %q", got, tt.content)
+                }
+            })
+        }
+        _ = source.close()
+    }
+}
@@ -1,29 +1,50 @@
 package core
 
 import (
-    "encoding/json"
+    "encoding/base64"
     "fmt"
+    "log"
+    "net/http"
+    "strings"
+    "time"
+
+    "github.com/go-resty/resty/v2"
 )
 
+// RegistryAuth is the authentication a registry asked for on /v2/. An empty
+// Scheme means the registry does not require any.
 type RegistryAuth struct {
-    Realm   string
-    Service string
-    Token   string
+    Scheme    string
+    Realm     string
+    Service   string
+    Scope     string
+    Token     string
+    // ExpiresAt is when Token expires.
+    ExpiresAt time.Time
 }
 
 type RegistryAccount struct {
     Username string
     Password string
+    // IdentityToken is the refresh token some registries hand out instead
+    // of keeping the password, as stored by docker login.
+    IdentityToken string
 }
 
 func (i *Image) prepareAuth() error {
-    resp, err := i.Client.R().Get(fmt.Sprintf("%s://%s/v2/", i.Scheme, i.Registry))
+    resp, err := i.ping()
     if err != nil {
         return err
     }
-    headers := resp.Header()
-    authHeader := headers.Get("Www-Authenticate")
-    registryAuth, err := matchAuthUrls(authHeader)
+    switch resp.StatusCode() {
+    case http.StatusOK:
+        i.AuthInfo = RegistryAuth{}
+        return nil
+    case http.StatusUnauthorized:
+    default:
+        return fmt.Errorf("unexpected response from %q\ncode: %d\nbody:%s", resp.Request.URL, resp.StatusCode(), resp.Body())
+    }
+    registryAuth, err := parseRegistryAuth(resp.Header().Values("Www-Authenticate"))
     if err != nil {
         return err
     }
@@ -31,32 +52,120 @@ func (i *Image) prepareAuth() error {
     return nil
 }
 
+// ping requests the /v2/ base. Like docker, https failures of localhost and
+// the InsecureRegistries of the config fall back to http, which is then used
+// for the registry for the rest of the process.
+func (i *Image) ping() (*resty.Response, error) {
+    host := i.apiHost()
+    if scheme, ok := probedSchemes.Load(host); ok && i.apiScheme() == "https" {
+        i.setAPIScheme(scheme.(string))
+    }
+    resp, err := i.Client.R().Get(i.v2URL())
+    if err == nil || i.apiScheme() != "https" || !i.registryConfig().isInsecure(host) {
+        return resp, err
+    }
+    log.Printf("ping %s: %v, falling back to http", host, err)
+    i.setAPIScheme("http")
+    resp, httpErr := i.Client.R().Get(i.v2URL())
+    if httpErr != nil {
+        i.setAPIScheme("https")
+        return nil, err
+    }
+    probedSchemes.Store(host, "http")
+    return resp, nil
+}
+
+// parseRegistryAuth picks the challenge to answer, preferring a token over
+// sending the credentials on every request.
+func parseRegistryAuth(headers []string) (*RegistryAuth, error) {
+    challenges := parseChallenges(headers...)
+    if c, ok := findChallenge(challenges, authSchemeBearer); ok {
+        if c.Params["realm"] == "" {
+            return nil, fmt.Errorf("no realm found in challenge %q", strings.Join(headers, ", "))
+        }
+        return &RegistryAuth{
+            Scheme:  authSchemeBearer,
+            Realm:   c.Params["realm"],
+            Service: c.Params["service"],
+            Scope:   c.Params["scope"],
+        }, nil
+    }
+    if c, ok := findChallenge(challenges, authSchemeBasic); ok {
+        return &RegistryAuth{
+            Scheme: authSchemeBasic,
+            Realm:  c.Params["realm"],
+        }, nil
+    }
+    return nil, fmt.Errorf("unsupported authentication challenge %q", strings.Join(headers, ", "))
+}
+
 func (i *Image) auth(operation string) error {
-    if i.AuthInfo.Realm == "" {
+    switch i.AuthInfo.Scheme {
+    case authSchemeBasic:
+        if i.Account == nil {
+            return fmt.Errorf("registry %s requires basic auth credentials", i.apiHost())
+        }
+        return nil
+    case authSchemeBearer:
+    default:
         return nil
     }
-    req := i.Client.R().
-        SetQueryParam("service", i.AuthInfo.Service).
-        SetQueryParam("scope", fmt.Sprintf("repository:%s/%s:%s", i.Repo, i.Name, operation))
-    if i.Account != nil {
-        req = req.
-            SetQueryParam("account", i.Account.Username).
-            SetBasicAuth(i.Account.Username, i.Account.Password)
+    i.authScopes = []string{fmt.Sprintf("repository:%s:%s", i.apiRepository(), operation)}
+    if strings.Contains(operation, "push") {
+        // blobs can only be mounted from repositories the token can pull
+        for _, from := range i.MountFrom {
+            i.authScopes = append(i.authScopes, fmt.Sprintf("repository:%s:pull", from))
+        }
     }
-    resp, err := req.Get(i.AuthInfo.Realm)
-    if err != nil {
-        return err
+    i.AuthInfo.Token = ""
+    return i.refreshToken(false)
+}
+
+// Authorization returns the Authorization header value for registry
+// requests, empty when the registry needs none.
+func (i *Image) Authorization() string {
+    switch i.AuthInfo.Scheme {
+    case authSchemeBearer:
+        return fmt.Sprintf("Bearer %s", i.AuthInfo.Token)
+    case authSchemeBasic:
+        if i.Account != nil {
+            credentials := i.Account.Username + ":" + i.Account.Password
+            return fmt.Sprintf("Basic %s", base64.StdEncoding.EncodeToString([]byte(credentials)))
+        }
     }
-    var content struct {
-        Token string `json:"token"`
+    return ""
+}
+
+// request returns a registry request carrying the authorization, if any,
+// bound to the context of the transfer it belongs to.
+func (i *Image) request() *resty.Request {
+    req := i.Client.R()
+    if i.ctx != nil {
+        req.SetContext(i.ctx)
     }
-    if err := json.Unmarshal(resp.Body(), &content); err != nil {
-        return err
+    if authorization := i.Authorization(); authorization != "" {
+        req.SetHeader("Authorization", authorization)
     }
-    i.AuthInfo.Token = content.Token
-    return nil
+    return req
 }
 
-func (i *Image) Authorization() string  {
-    return fmt.Sprintf("Bearer %s", i.AuthInfo.Token)
-}
\ No newline at end of file
+// send executes the request built by build against url. Bearer tokens about
+// to expire are refreshed first, and a request answered with 401 is retried
+// once with a new token. build may run twice, so it must not consume state.
+func (i *Image) send(method, url string, build func(*resty.Request) *resty.Request) (*resty.Response, error) {
+    if err := i.refreshToken(false); err != nil {
+        return nil, err
+    }
+    resp, err := build(i.request()).Execute(method, url)
+    if err != nil || resp.StatusCode() != http.StatusUnauthorized || i.AuthInfo.Scheme != authSchemeBearer {
+        return resp, err
+    }
+    if body := resp.RawBody(); body != nil {
+        _ = body.Close()
+    }
+    log.Printf("%s %s unauthorized, refreshing token", method, url)
+    if err := i.refreshToken(true); err != nil {
+        return nil, err
+    }
+    return build(i.request()).Execute(method, url)
+}
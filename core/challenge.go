@@ -0,0 +1,160 @@
+package core
+
+import (
+    "strings"
+)
+
+const (
+    authSchemeBasic  = "basic"
+    authSchemeBearer = "bearer"
+)
+
+// authChallenge is one challenge of a WWW-Authenticate header. Scheme and
+// parameter names are lower cased since they are case-insensitive.
+type authChallenge struct {
+    Scheme  string
+    Params  map[string]string
+    Token68 string
+}
+
+// parseChallenges parses WWW-Authenticate header values as defined by
+// RFC 7235, where a single value may carry several challenges:
+//
+//   Bearer realm="https://auth.example.com/token",service="registry",scope="repository:foo:pull"
+//   Basic realm="Registry Realm", Bearer realm="..."
+func parseChallenges(headers ...string) []authChallenge {
+    var challenges []authChallenge
+    for _, header := range headers {
+        p := challengeParser{s: header}
+        for {
+            challenge, ok := p.challenge()
+            if !ok {
+                break
+            }
+            challenges = append(challenges, challenge)
+        }
+    }
+    return challenges
+}
+
+// findChallenge returns the first challenge using scheme.
+func findChallenge(challenges []authChallenge, scheme string) (authChallenge, bool) {
+    for _, c := range challenges {
+        if c.Scheme == scheme {
+            return c, true
+        }
+    }
+    return authChallenge{}, false
+}
+
+type challengeParser struct {
+    s   string
+    pos int
+}
+
+func (p *challengeParser) peek() byte {
+    if p.pos < len(p.s) {
+        return p.s[p.pos]
+    }
+    return 0
+}
+
+func (p *challengeParser) skipSpaces() {
+    for p.pos < len(p.s) && (p.s[p.pos] == ' ' || p.s[p.pos] == '\t') {
+        p.pos++
+    }
+}
+
+func (p *challengeParser) skipSeparators() {
+    for p.pos < len(p.s) && (p.s[p.pos] == ' ' || p.s[p.pos] == '\t' || p.s[p.pos] == ',') {
+        p.pos++
+    }
+}
+
+func (p *challengeParser) token() string {
+    start := p.pos
+    for p.pos < len(p.s) && isTokenChar(p.s[p.pos]) {
+        p.pos++
+    }
+    return p.s[start:p.pos]
+}
+
+// value reads a quoted-string or a token. Unquoted values are read up to the
+// next separator, since some registries send bare urls.
+func (p *challengeParser) value() string {
+    if p.peek() != '"' {
+        start := p.pos
+        for p.pos < len(p.s) && p.s[p.pos] != ',' && p.s[p.pos] != ' ' && p.s[p.pos] != '\t' {
+            p.pos++
+        }
+        return p.s[start:p.pos]
+    }
+    p.pos++
+    var b strings.Builder
+    for p.pos < len(p.s) {
+        c := p.s[p.pos]
+        p.pos++
+        switch {
+        case c == '"':
+            return b.String()
+        case c == '\\' && p.pos < len(p.s):
+            b.WriteByte(p.s[p.pos])
+            p.pos++
+        default:
+            b.WriteByte(c)
+        }
+    }
+    return b.String()
+}
+
+func (p *challengeParser) challenge() (authChallenge, bool) {
+    p.skipSeparators()
+    scheme := p.token()
+    if scheme == "" {
+        return authChallenge{}, false
+    }
+    challenge := authChallenge{
+        Scheme: strings.ToLower(scheme),
+        Params: map[string]string{},
+    }
+    first := true
+    for {
+        p.skipSpaces()
+        start := p.pos
+        name := p.token()
+        p.skipSpaces()
+        isParam := name != "" && p.peek() == '='
+        if isParam {
+            p.pos++
+            p.skipSpaces()
+            c := p.peek()
+            isParam = c != '=' && c != ',' && c != 0
+        }
+        if !isParam {
+            p.pos = start
+            if first {
+                // a token68 directly follows the scheme, anything else after
+                // a comma starts the next challenge
+                if c := p.peek(); c != ',' && c != 0 {
+                    challenge.Token68 = p.value()
+                }
+            }
+            return challenge, true
+        }
+        challenge.Params[strings.ToLower(name)] = p.value()
+        first = false
+        p.skipSpaces()
+        if p.peek() != ',' {
+            return challenge, true
+        }
+        p.skipSeparators()
+    }
+}
+
+func isTokenChar(c byte) bool {
+    switch {
+    case c >= 'a' && c <= 'z', c >= 'A' && c <= 'Z', c >= '0' && c <= '9':
+        return true
+    }
+    return strings.IndexByte("!#$%&'*+-.^_`|~", c) >= 0
+}
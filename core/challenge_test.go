@@ -0,0 +1,108 @@
+package core
+
+import (
+    "reflect"
+    "testing"
+)
+
+func TestParseChallenges(t *testing.T) {
+    tests := []struct {
+        name    string
+        headers []string
+        want    []authChallenge
+    }{
+        {
+            name:    "bearer",
+            headers: []string{`Bearer realm="https://auth.docker.io/token",service="registry.docker.io",scope="repository:library/busybox:pull"`},
+            want: []authChallenge{{
+                Scheme: authSchemeBearer,
+                Params: map[string]string{
+                    "realm":   "https://auth.docker.io/token",
+                    "service": "registry.docker.io",
+                    "scope":   "repository:library/busybox:pull",
+                },
+            }},
+        },
+        {
+            name:    "quoted commas and escapes",
+            headers: []string{`Bearer realm="https://auth.example.com/token",scope="repository:a:pull,push repository:b:pull",error="say \"hi\""`},
+            want: []authChallenge{{
+                Scheme: authSchemeBearer,
+                Params: map[string]string{
+                    "realm": "https://auth.example.com/token",
+                    "scope": "repository:a:pull,push repository:b:pull",
+                    "error": `say "hi"`,
+                },
+            }},
+        },
+        {
+            name:    "several challenges in one header",
+            headers: []string{`Basic realm="Registry Realm", Bearer realm="https://auth.example.com/token",service="registry"`},
+            want: []authChallenge{
+                {Scheme: authSchemeBasic, Params: map[string]string{"realm": "Registry Realm"}},
+                {Scheme: authSchemeBearer, Params: map[string]string{"realm": "https://auth.example.com/token", "service": "registry"}},
+            },
+        },
+        {
+            name:    "several headers",
+            headers: []string{`Basic realm="r"`, `Bearer realm="https://auth.example.com/token"`},
+            want: []authChallenge{
+                {Scheme: authSchemeBasic, Params: map[string]string{"realm": "r"}},
+                {Scheme: authSchemeBearer, Params: map[string]string{"realm": "https://auth.example.com/token"}},
+            },
+        },
+        {
+            name:    "case insensitive scheme and names",
+            headers: []string{`BEARER Realm="https://auth.example.com/token", SERVICE = registry`},
+            want: []authChallenge{{
+                Scheme: authSchemeBearer,
+                Params: map[string]string{"realm": "https://auth.example.com/token", "service": "registry"},
+            }},
+        },
+        {
+            name:    "unquoted url",
+            headers: []string{`Bearer realm=https://auth.example.com/token?a=b,service=registry`},
+            want: []authChallenge{{
+                Scheme: authSchemeBearer,
+                Params: map[string]string{"realm": "https://auth.example.com/token?a=b", "service": "registry"},
+            }},
+        },
+        {
+            name:    "token68",
+            headers: []string{`Negotiate dXNlcjpwYXNz==, Basic realm="r"`},
+            want: []authChallenge{
+                {Scheme: "negotiate", Params: map[string]string{}, Token68: "dXNlcjpwYXNz=="},
+                {Scheme: authSchemeBasic, Params: map[string]string{"realm": "r"}},
+            },
+        },
+        {
+            name:    "scheme without parameters",
+            headers: []string{`Basic`},
+            want:    []authChallenge{{Scheme: authSchemeBasic, Params: map[string]string{}}},
+        },
+        {
+            name:    "empty",
+            headers: []string{``, ` , `},
+            want:    nil,
+        },
+    }
+    for _, tt := range tests {
+        t.Run(tt.name, func(t *testing.T) {
+            got := parseChallenges(tt.headers...)
+            if !reflect.DeepEqual(got, tt.want) {
+                t.Errorf("parseChallenges(%q) = %#v, want %#v", tt.headers, got, tt.want)
+            }
+        })
+    }
+}
+
+func TestFindChallenge(t *testing.T) {
+    challenges := parseChallenges(`Basic realm="r", Bearer realm="https://auth.example.com/token"`)
+    got, ok := findChallenge(challenges, authSchemeBearer)
+    if !ok || got.Params["realm"] != "https://auth.example.com/token" {
+        t.Errorf("findChallenge(bearer) = %#v, %v", got, ok)
+    }
+    if _, ok := findChallenge(challenges, "digest"); ok {
+        t.Errorf("findChallenge(digest) found a challenge")
+    }
+}
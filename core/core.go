@@ -1,17 +1,19 @@
 package core
 
 import (
-    "errors"
+    "compress/gzip"
+    "context"
     "fmt"
+    "io"
+    "log"
+    "os"
+    "path"
     "path/filepath"
     "strings"
 
     "github.com/go-resty/resty/v2"
-)
-
-const (
-    targetArch = "amd64"
-    targetOS   = "linux"
+    "github.com/opencontainers/go-digest"
+    v1 "github.com/opencontainers/image-spec/specs-go/v1"
 )
 
 type Image struct {
@@ -20,18 +22,69 @@ type Image struct {
     Repo     string
     Name     string
     Tag      string
+    Digest   digest.Digest
     Scheme   string
+    // PathPrefix is the path the registry API is served under, for
+    // registries behind a reverse proxy.
+    PathPrefix string
     Account  *RegistryAccount
     AuthInfo RegistryAuth
+    Platform Platform
+    // OutputFormat selects how Pull writes the image.
+    OutputFormat OutputFormat
+
+    // ManifestFormat selects the manifest media types used by Push.
+    ManifestFormat ManifestFormat
+    // Annotations are added to the OCI manifests built by Push; docker
+    // schema2 manifests cannot carry them.
+    Annotations map[string]string
+    // MountFrom lists repositories of the same registry, such as
+    // library/alpine, that Push mounts missing blobs from before uploading
+    // them.
+    MountFrom []string
+
+    // ManifestDigest is the digest of the manifest resolved by the last
+    // Pull or uploaded by the last Push.
+    ManifestDigest digest.Digest
+
+    // Mirrors are tried in order by pulls before the registry, see
+    // RegistryHost.
+    Mirrors []string
+    // MirrorNamespace is prepended to the repository on the Mirrors.
+    MirrorNamespace string
+
+    // Parallelism is how many blobs Pull and Push transfer at the same time,
+    // one at a time when below 2.
+    Parallelism int
+
+    ctx        context.Context
+    authScopes []string
+    tokens     *tokenCache
+    config     *RegistryConfig
+    mirror     *registryEndpoint
 }
 
+// NewImage parses s into an image using DefaultRegistryConfig. A nil account
+// is looked up with LoadAccount.
 func NewImage(s string, insecure bool, account *RegistryAccount) (*Image, error) {
-    if strings.HasPrefix(s, "docker.io") {
-        s = strings.ReplaceAll(s, "docker.io", "registry-1.docker.io")
+    return DefaultRegistryConfig.NewImage(s, insecure, account)
+}
+
+// NewImage parses s into an image, applying the rewrites, endpoint and
+// mirrors configured for its registry.
+func (c *RegistryConfig) NewImage(s string, insecure bool, account *RegistryAccount) (*Image, error) {
+    ref, err := ParseReference(s)
+    if err != nil {
+        return nil, err
     }
-    if strings.HasPrefix(s, "k8s.gcr.io") {
-        s = strings.ReplaceAll(s, "k8s.gcr.io", "gcr.io/google-containers")
+    if name := c.rewrite(path.Join(ref.Registry, ref.Repository)); name != path.Join(ref.Registry, ref.Repository) {
+        parts := strings.SplitN(name, "/", 2)
+        if len(parts) != 2 {
+            return nil, fmt.Errorf("rewrite of %s to %s has no repository", s, name)
+        }
+        ref.Registry, ref.Repository = parts[0], parts[1]
     }
+    host := c.Hosts[ref.Registry]
 
     var image Image
     if insecure {
@@ -39,42 +92,101 @@ func NewImage(s string, insecure bool, account *RegistryAccount) (*Image, error)
     }else {
         image.Scheme = "https"
     }
-    image.Account = account
-    image.Client = resty.New()
-    slashSplitStr := strings.Split(s, "/")
-    switch len(slashSplitStr) {
-    case 1:
-        image.Registry = "registry-1.docker.io"
-        image.Repo = "library"
-        if imageName, tag, err := parseTag(s); err != nil {
-            return nil, err
-        } else {
-            image.Name = imageName
-            image.Tag = tag
+    image.Registry = ref.Registry
+    if host.Endpoint != "" {
+        endpoint, err := parseEndpoint(host.Endpoint, image.Scheme)
+        if err != nil {
+            return nil, fmt.Errorf("endpoint of %s: %v", ref.Registry, err)
         }
-        return &image, nil
-    case 2:
-        image.Registry = "registry-1.docker.io"
-        image.Repo = slashSplitStr[0]
-        if imageName, tag, err := parseTag(slashSplitStr[1]); err != nil {
-            return nil, err
-        } else {
-            image.Name = imageName
-            image.Tag = tag
+        image.Scheme = endpoint.scheme
+        image.Registry = endpoint.host
+        image.PathPrefix = endpoint.prefix
+    }
+    if account == nil {
+        if account, err = LoadAccount(image.Registry); err != nil {
+            log.Printf("load credentials for %s: %v", image.Registry, err)
         }
-        return &image, nil
-    case 3:
-        image.Registry = slashSplitStr[0]
-        image.Repo = slashSplitStr[1]
-        if imageName, tag, err := parseTag(slashSplitStr[2]); err != nil {
-            return nil, err
-        } else {
-            image.Name = imageName
-            image.Tag = tag
+    }
+    image.Account = account
+    image.tokens = newTokenCache()
+    image.config = c
+    image.Client = resty.New()
+    tlsConfig, err := c.tlsConfig(image.Registry)
+    if err != nil {
+        return nil, err
+    }
+    if tlsConfig != nil {
+        image.Client.SetTLSClientConfig(tlsConfig)
+    }
+    image.Platform = DefaultPlatform
+    image.Parallelism = defaultParallelism
+    image.Mirrors = append([]string(nil), host.Mirrors...)
+    image.MirrorNamespace = host.MirrorNamespace
+    image.Repo = ref.Repo()
+    image.Name = ref.Name()
+    image.Tag = ref.Tag
+    image.Digest = ref.Digest
+    return &image, nil
+}
+
+// withReference returns an image for s sharing the settings of i. The
+// account, client, scheme and MountFrom are only shared within the same
+// registry; other registries get those NewImage configures for them.
+func (i *Image) withReference(s string) (*Image, error) {
+    image, err := i.registryConfig().NewImage(s, false, nil)
+    if err != nil {
+        return nil, err
+    }
+    if image.Registry == i.Registry {
+        image.Account = i.Account
+        image.tokens = i.tokens
+        image.MountFrom = i.MountFrom
+        image.Client = i.Client
+        image.Scheme = i.Scheme
+    }
+    image.Platform = i.Platform
+    image.OutputFormat = i.OutputFormat
+    image.ManifestFormat = i.ManifestFormat
+    image.Annotations = i.Annotations
+    image.Parallelism = i.Parallelism
+    return image, nil
+}
+
+func (i *Image) repository() string {
+    return path.Join(i.Repo, i.Name)
+}
+
+// manifestReference returns the digest when the image is pinned by one and
+// the tag otherwise.
+func (i *Image) manifestReference() string {
+    if i.Digest != "" {
+        return i.Digest.String()
+    }
+    return i.Tag
+}
+
+func (i *Image) repoTags() []string {
+    if i.Tag == "" {
+        return nil
+    }
+    return []string{fmt.Sprintf("%s:%s", i.Name, i.Tag)}
+}
+
+// layoutAnnotations names the image stored as the manifest d in an OCI
+// layout index.json, both with the OCI reference name and the name
+// containerd imports it under. Images pulled by digest are named after d,
+// which differs from the digest pulled when a platform was picked out of a
+// manifest list.
+func (i *Image) layoutAnnotations(d digest.Digest) map[string]string {
+    name := path.Join(i.Registry, i.repository())
+    if i.Tag == "" {
+        return map[string]string{
+            containerdImageNameAnnotation: fmt.Sprintf("%s@%s", name, d),
         }
-        return &image, nil
-    default:
-        return nil, errors.New(fmt.Sprintf("error image format: %q", s))
+    }
+    return map[string]string{
+        v1.AnnotationRefName:          fmt.Sprintf("%s:%s", name, i.Tag),
+        containerdImageNameAnnotation: fmt.Sprintf("%s:%s", name, i.Tag),
     }
 }
 
@@ -83,20 +195,85 @@ func (i *Image) TargetPath(directory string) string {
 }
 
 func (i *Image) Pull(directory string) error {
+    return i.withMirrors(func() error {
+        return i.pull(directory)
+    })
+}
+
+// PullArchive saves the image as a single docker-save tarball, loadable with
+// docker load. The archive is gzip compressed when file ends in .gz or .tgz.
+func (i *Image) PullArchive(file string) error {
+    return i.withMirrors(func() error {
+        return i.pullArchiveFile(file)
+    })
+}
+
+func (i *Image) pullArchiveFile(file string) error {
+    f, err := os.Create(file)
+    if err != nil {
+        return err
+    }
+    var w io.WriteCloser = f
+    if strings.HasSuffix(file, ".gz") || strings.HasSuffix(file, ".tgz") {
+        w = gzip.NewWriter(f)
+    }
+    err = i.pullArchive(w)
+    if w != f {
+        if closeErr := w.Close(); err == nil {
+            err = closeErr
+        }
+    }
+    if closeErr := f.Close(); err == nil {
+        err = closeErr
+    }
+    if err != nil {
+        _ = os.Remove(file)
+        return err
+    }
+    return nil
+}
+
+// PullPlatforms saves every platform of the image's manifest list, or only
+// those matching platforms, into the OCI image layout at directory. A
+// reference to a single image fails when it matches none of platforms.
+func (i *Image) PullPlatforms(directory string, platforms ...Platform) error {
+    return i.withMirrors(func() error {
+        return i.pullPlatforms(directory, platforms)
+    })
+}
+
+// Push uploads a local image. source is a docker-save style directory or
+// tarball, optionally gzip compressed, or an OCI image layout directory or
+// archive; archives are read in place without being extracted.
+func (i *Image) Push(source string) error {
     if err := i.prepareAuth(); err != nil {
         return err
     }
-    if err := i.pull(directory); err != nil {
+    if err := i.push(source); err != nil {
         return err
     }
     return nil
 }
 
-func (i *Image) Push(directory string) error {
+// PushRepoTags pushes every image of a docker-save style directory or
+// tarball under each of its RepoTags, using the settings of i; tags on
+// other registries get the client and credentials configured for them.
+// When prefix is set the tags are moved below it, so with prefix
+// registry.example.com/mirror the tag nginx:1.19 is pushed as
+// registry.example.com/mirror/library/nginx:1.19. The registry of a tag is
+// dropped, so tags of different registries landing on the same name are an
+// error, reported before anything is pushed.
+func (i *Image) PushRepoTags(source, prefix string) error {
+    return i.pushRepoTags(source, prefix)
+}
+
+// PushPlatforms pushes one docker-save style directory or tarball per
+// platform and tags a manifest list referencing all of them.
+func (i *Image) PushPlatforms(sources ...string) error {
     if err := i.prepareAuth(); err != nil {
         return err
     }
-    if err := i.push(directory); err != nil {
+    if err := i.pushPlatforms(sources); err != nil {
         return err
     }
     return nil
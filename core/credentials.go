@@ -0,0 +1,174 @@
+package core
+
+import (
+    "bytes"
+    "encoding/base64"
+    "encoding/json"
+    "fmt"
+    "io/ioutil"
+    "os"
+    "os/exec"
+    "path/filepath"
+    "strings"
+)
+
+// dockerHubServer is the key docker login uses for Docker Hub credentials.
+const dockerHubServer = "https://index.docker.io/v1/"
+
+// identityTokenUsername is the username credential helpers return for
+// identity tokens.
+const identityTokenUsername = "<token>"
+
+type dockerConfig struct {
+    Auths       map[string]dockerAuthConfig `json:"auths"`
+    CredsStore  string                      `json:"credsStore"`
+    CredHelpers map[string]string           `json:"credHelpers"`
+}
+
+type dockerAuthConfig struct {
+    Auth          string `json:"auth"`
+    Username      string `json:"username"`
+    Password      string `json:"password"`
+    IdentityToken string `json:"identitytoken"`
+}
+
+// LoadAccount resolves the credentials for registry the way docker login
+// stores them: a credential helper configured for the registry in credHelpers,
+// then the credsStore, then the auths section of config.json. The config is
+// read from $DOCKER_CONFIG, or ~/.docker. A nil account means no credentials
+// are configured.
+func LoadAccount(registry string) (*RegistryAccount, error) {
+    config, err := loadDockerConfig()
+    if err != nil || config == nil {
+        return nil, err
+    }
+    server := credentialServer(registry)
+    if helper := config.credHelper(server); helper != "" {
+        return helperAccount(helper, server)
+    }
+    if config.CredsStore != "" {
+        account, err := helperAccount(config.CredsStore, server)
+        if err != nil || account != nil {
+            return account, err
+        }
+    }
+    for key, auth := range config.Auths {
+        if credentialServer(key) == server {
+            return auth.account()
+        }
+    }
+    return nil, nil
+}
+
+func dockerConfigDir() string {
+    if dir := os.Getenv("DOCKER_CONFIG"); dir != "" {
+        return dir
+    }
+    home, err := os.UserHomeDir()
+    if err != nil {
+        return ""
+    }
+    return filepath.Join(home, ".docker")
+}
+
+func loadDockerConfig() (*dockerConfig, error) {
+    dir := dockerConfigDir()
+    if dir == "" {
+        return nil, nil
+    }
+    file := filepath.Join(dir, "config.json")
+    content, err := ioutil.ReadFile(file)
+    if os.IsNotExist(err) {
+        return nil, nil
+    }
+    if err != nil {
+        return nil, err
+    }
+    var config dockerConfig
+    if err := json.Unmarshal(content, &config); err != nil {
+        return nil, fmt.Errorf("parse %s: %v", file, err)
+    }
+    return &config, nil
+}
+
+func (c *dockerConfig) credHelper(server string) string {
+    for key, helper := range c.CredHelpers {
+        if credentialServer(key) == server {
+            return helper
+        }
+    }
+    return ""
+}
+
+// credentialServer returns the key credentials for registry are stored under:
+// its host, or dockerHubServer for Docker Hub. Keys written by older docker
+// versions carry a scheme and a path, which are dropped.
+func credentialServer(registry string) string {
+    host := registry
+    if idx := strings.Index(host, "://"); idx >= 0 {
+        host = host[idx+3:]
+    }
+    if idx := strings.Index(host, "/"); idx >= 0 {
+        host = host[:idx]
+    }
+    switch host {
+    case "docker.io", "index.docker.io", defaultRegistry:
+        return dockerHubServer
+    }
+    return host
+}
+
+func (a dockerAuthConfig) account() (*RegistryAccount, error) {
+    account := RegistryAccount{
+        Username:      a.Username,
+        Password:      a.Password,
+        IdentityToken: a.IdentityToken,
+    }
+    if a.Auth != "" {
+        decoded, err := base64.StdEncoding.DecodeString(a.Auth)
+        if err != nil {
+            return nil, fmt.Errorf("decode auth field: %v", err)
+        }
+        parts := strings.SplitN(string(decoded), ":", 2)
+        if len(parts) != 2 {
+            return nil, fmt.Errorf("auth field is not username:password")
+        }
+        account.Username, account.Password = parts[0], parts[1]
+    }
+    if account.Username == "" && account.Password == "" && account.IdentityToken == "" {
+        return nil, nil
+    }
+    return &account, nil
+}
+
+// helperAccount runs docker-credential-<helper> get, which reads the server
+// on stdin and prints {"ServerURL", "Username", "Secret"}.
+func helperAccount(helper, server string) (*RegistryAccount, error) {
+    program := "docker-credential-" + helper
+    cmd := exec.Command(program, "get")
+    cmd.Stdin = strings.NewReader(server)
+    var stdout, stderr bytes.Buffer
+    cmd.Stdout = &stdout
+    cmd.Stderr = &stderr
+    if err := cmd.Run(); err != nil {
+        output := strings.TrimSpace(stdout.String() + stderr.String())
+        if strings.Contains(output, "credentials not found") {
+            return nil, nil
+        }
+        return nil, fmt.Errorf("%s get: %v: %s", program, err, output)
+    }
+    var credentials struct {
+        Username string `json:"Username"`
+        Secret   string `json:"Secret"`
+    }
+    if err := json.Unmarshal(stdout.Bytes(), &credentials); err != nil {
+        return nil, fmt.Errorf("%s get: %v", program, err)
+    }
+    if credentials.Username == identityTokenUsername {
+        return &RegistryAccount{IdentityToken: credentials.Secret}, nil
+    }
+    return &RegistryAccount{
+        Username: credentials.Username,
+        Password: credentials.Secret,
+    }, nil
+}
@@ -0,0 +1,309 @@
+package core
+
+import (
+    "encoding/json"
+    "fmt"
+    "io/ioutil"
+    "log"
+    "net"
+    "net/url"
+    "path"
+    "strings"
+    "sync"
+
+    "github.com/go-resty/resty/v2"
+)
+
+// RegistryHost configures the hosts serving a registry. The TLS settings
+// apply to connections to the host it is keyed by, mirrors and endpoints
+// get the ones of their own entry.
+type RegistryHost struct {
+    // Endpoint is the host serving the registry API when it differs from
+    // the registry name, such as registry-1.docker.io for docker.io. It may
+    // carry a scheme, a port and the path the API is served under behind a
+    // reverse proxy, e.g. https://proxy.local:8443/registry.
+    Endpoint string `json:"endpoint,omitempty"`
+    // Mirrors are tried in order by pulls before the registry itself. A
+    // mirror is a host with an optional http:// or https:// scheme and an
+    // optional path the API is served under, like Endpoint, e.g.
+    // http://proxy.local:5000/cache.
+    Mirrors []string `json:"mirrors,omitempty"`
+    // MirrorNamespace is prepended to repositories on the mirrors, for
+    // caches serving a registry below a project, e.g. dockerhub for a Harbor
+    // proxy cache serving library/nginx as dockerhub/library/nginx.
+    MirrorNamespace string `json:"mirrorNamespace,omitempty"`
+
+    // CAFile is a PEM bundle of certificate authorities trusted on top of
+    // the system ones.
+    CAFile string `json:"ca,omitempty"`
+    // CertFile and KeyFile are a client certificate for mutual TLS.
+    CertFile string `json:"cert,omitempty"`
+    KeyFile  string `json:"key,omitempty"`
+    // SkipVerify keeps https but does not verify the server certificate.
+    SkipVerify bool `json:"skipVerify,omitempty"`
+}
+
+// RegistryRewrite moves the references below From to below To, both being a
+// registry with an optional repository path.
+type RegistryRewrite struct {
+    From string `json:"from"`
+    To   string `json:"to"`
+}
+
+// RegistryConfig tells NewImage where the images of each registry live, in
+// the spirit of containerd's hosts.toml and registries.conf.
+type RegistryConfig struct {
+    // Hosts is keyed by registry name, after rewriting.
+    Hosts map[string]RegistryHost `json:"hosts,omitempty"`
+    // Rewrites are applied in order, the first matching one wins.
+    Rewrites []RegistryRewrite `json:"rewrites,omitempty"`
+    // CertsDir holds per-host certificates in the layout of
+    // /etc/docker/certs.d.
+    CertsDir string `json:"certsDir,omitempty"`
+    // InsecureRegistries lists hosts, with or without port, and CIDRs that
+    // may be reached over plain http when https fails. Loopback addresses
+    // and localhost always may.
+    InsecureRegistries []string `json:"insecureRegistries,omitempty"`
+}
+
+// DefaultRegistryConfig is used by NewImage.
+var DefaultRegistryConfig = RegistryConfig{
+    Hosts: map[string]RegistryHost{
+        "docker.io": {Endpoint: defaultRegistry},
+    },
+    Rewrites: []RegistryRewrite{
+        {From: "k8s.gcr.io", To: "gcr.io/google-containers"},
+    },
+    CertsDir: defaultCertsDir,
+}
+
+// LoadRegistryConfig reads a RegistryConfig from a json file.
+func LoadRegistryConfig(file string) (*RegistryConfig, error) {
+    content, err := ioutil.ReadFile(file)
+    if err != nil {
+        return nil, err
+    }
+    var config RegistryConfig
+    if err := json.Unmarshal(content, &config); err != nil {
+        return nil, fmt.Errorf("parse %s: %v", file, err)
+    }
+    return &config, nil
+}
+
+func (i *Image) registryConfig() *RegistryConfig {
+    if i.config == nil {
+        return &DefaultRegistryConfig
+    }
+    return i.config
+}
+
+// rewrite applies the first rewrite whose From is name or a parent path of
+// it.
+func (c *RegistryConfig) rewrite(name string) string {
+    for _, r := range c.Rewrites {
+        from := strings.TrimSuffix(r.From, "/")
+        if name == from {
+            return strings.TrimSuffix(r.To, "/")
+        }
+        if strings.HasPrefix(name, from+"/") {
+            return path.Join(r.To, strings.TrimPrefix(name, from+"/"))
+        }
+    }
+    return name
+}
+
+// registryEndpoint is a host serving the API of a registry in its place,
+// below prefix, with the repositories below namespace.
+type registryEndpoint struct {
+    scheme    string
+    host      string
+    prefix    string
+    namespace string
+    account   *RegistryAccount
+    // client replaces the image's client when the mirror has its own TLS
+    // configuration.
+    client *resty.Client
+}
+
+// parseEndpoint parses [scheme://]host[/prefix], defaulting the scheme to
+// the one of the image.
+func parseEndpoint(s, defaultScheme string) (*registryEndpoint, error) {
+    endpoint := registryEndpoint{scheme: defaultScheme}
+    if idx := strings.Index(s, "://"); idx >= 0 {
+        endpoint.scheme, s = s[:idx], s[idx+3:]
+    }
+    if endpoint.scheme != "http" && endpoint.scheme != "https" {
+        return nil, fmt.Errorf("unsupported scheme %q", endpoint.scheme)
+    }
+    s = strings.Trim(s, "/")
+    if idx := strings.Index(s, "/"); idx >= 0 {
+        s, endpoint.prefix = s[:idx], s[idx+1:]
+    }
+    if s == "" {
+        return nil, fmt.Errorf("no host found")
+    }
+    endpoint.host = s
+    return &endpoint, nil
+}
+
+// probedSchemes remembers the registries ping fell back to http for.
+var probedSchemes sync.Map
+
+// isInsecure reports whether host may be reached over plain http.
+func (c *RegistryConfig) isInsecure(host string) bool {
+    hostname := host
+    if h, _, err := net.SplitHostPort(host); err == nil {
+        hostname = h
+    }
+    hostname = strings.Trim(hostname, "[]")
+    var ips []net.IP
+    if ip := net.ParseIP(hostname); ip != nil {
+        ips = append(ips, ip)
+    }
+    if hostname == "localhost" || (len(ips) == 1 && ips[0].IsLoopback()) {
+        return true
+    }
+    for _, entry := range c.InsecureRegistries {
+        _, network, err := net.ParseCIDR(entry)
+        if err != nil {
+            if entry == host || entry == hostname {
+                return true
+            }
+            continue
+        }
+        if ips == nil {
+            // resolve once, and only when there is a CIDR to match
+            if ips, err = net.LookupIP(hostname); err != nil {
+                ips = []net.IP{}
+            }
+        }
+        for _, ip := range ips {
+            if network.Contains(ip) {
+                return true
+            }
+        }
+    }
+    return false
+}
+
+func (i *Image) setAPIScheme(scheme string) {
+    if i.mirror != nil {
+        i.mirror.scheme = scheme
+        return
+    }
+    i.Scheme = scheme
+}
+
+// apiScheme, apiHost and apiRepository locate the repository for requests,
+// on the mirror being tried if any.
+func (i *Image) apiScheme() string {
+    if i.mirror != nil {
+        return i.mirror.scheme
+    }
+    return i.Scheme
+}
+
+func (i *Image) apiHost() string {
+    if i.mirror != nil {
+        return i.mirror.host
+    }
+    return i.Registry
+}
+
+func (i *Image) apiRepository() string {
+    if i.mirror != nil {
+        return path.Join(i.mirror.namespace, i.repository())
+    }
+    return i.repository()
+}
+
+// v2URL builds the url of the registry API path made of parts, below
+// PathPrefix or the prefix of the mirror being tried. A trailing slash of
+// the last part is kept, as in blobs/uploads/, and no parts at all is the
+// /v2/ base.
+func (i *Image) v2URL(parts ...string) string {
+    root := i.PathPrefix
+    if i.mirror != nil {
+        root = i.mirror.prefix
+    }
+    p := "/" + path.Join(append([]string{root, "v2"}, parts...)...)
+    if len(parts) == 0 || strings.HasSuffix(parts[len(parts)-1], "/") {
+        p += "/"
+    }
+    u := url.URL{
+        Scheme: i.apiScheme(),
+        Host:   i.apiHost(),
+        Path:   p,
+    }
+    return u.String()
+}
+
+// repositoryURL builds the url of a path below the repository, such as
+// manifests/<reference>, blobs/<digest>, blobs/uploads/ or tags/list.
+func (i *Image) repositoryURL(parts ...string) string {
+    return i.v2URL(append([]string{i.apiRepository()}, parts...)...)
+}
+
+// locationURL returns the Location header of resp, resolving relative
+// locations against the request url.
+func locationURL(resp *resty.Response) (string, error) {
+    location := resp.Header().Get("Location")
+    if location == "" {
+        return "", nil
+    }
+    ref, err := url.Parse(location)
+    if err != nil {
+        return "", err
+    }
+    base, err := url.Parse(resp.Request.URL)
+    if err != nil {
+        return "", err
+    }
+    return base.ResolveReference(ref).String(), nil
+}
+
+// withMirrors runs pull against each of the Mirrors in turn and then against
+// the registry itself, until one succeeds.
+func (i *Image) withMirrors(pull func() error) error {
+    for _, mirror := range i.Mirrors {
+        endpoint, err := parseEndpoint(mirror, i.Scheme)
+        if err != nil {
+            return fmt.Errorf("mirror %q: %v", mirror, err)
+        }
+        endpoint.namespace = i.MirrorNamespace
+        if endpoint.account, err = LoadAccount(endpoint.host); err != nil {
+            log.Printf("load credentials for %s: %v", endpoint.host, err)
+        }
+        tlsConfig, err := i.registryConfig().tlsConfig(endpoint.host)
+        if err != nil {
+            return fmt.Errorf("mirror %q: %v", mirror, err)
+        }
+        if tlsConfig != nil {
+            endpoint.client = resty.New().SetTLSClientConfig(tlsConfig)
+        }
+        if err := i.withMirror(endpoint, pull); err != nil {
+            log.Printf("pull from mirror %s failed: %v", mirror, err)
+            continue
+        }
+        return nil
+    }
+    if err := i.prepareAuth(); err != nil {
+        return err
+    }
+    return pull()
+}
+
+func (i *Image) withMirror(endpoint *registryEndpoint, pull func() error) error {
+    account, authInfo, client := i.Account, i.AuthInfo, i.Client
+    i.mirror, i.Account = endpoint, endpoint.account
+    if endpoint.client != nil {
+        i.Client = endpoint.client
+    }
+    defer func() {
+        i.mirror, i.Account, i.AuthInfo, i.Client = nil, account, authInfo, client
+    }()
+    if err := i.prepareAuth(); err != nil {
+        return err
+    }
+    return pull()
+}
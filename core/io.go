@@ -2,144 +2,356 @@ package core
 
 import (
     "bytes"
-    "crypto/sha256"
-    "encoding/hex"
-    "encoding/json"
+    "errors"
     "fmt"
     "io"
+    "io/ioutil"
     "log"
     "net/http"
     "os"
+    "path/filepath"
 
-    "github.com/docker/distribution/manifest/schema2"
+    "github.com/go-resty/resty/v2"
+    "github.com/opencontainers/go-digest"
 )
 
 const (
     chunkSize = 2097152
+    // downloadRetries is how many times a blob download is resumed after
+    // its connection broke.
+    downloadRetries = 3
 )
 
-func (i *Image) fetchBlob(digest, targetFile string) error {
-    r, err := i.Client.
-        R().
-        SetHeader("Authorization", fmt.Sprintf("Bearer %s", i.AuthInfo.Token)).
-        SetOutput(targetFile).
-        Get(fmt.Sprintf("https://%s/v2/%s/%s/blobs/%s", i.Registry, i.Repo, i.Name, digest))
+// fetchBlobTo streams the blob into w, verifying it against its digest and
+// size, which may be negative when unknown.
+func (i *Image) fetchBlobTo(dgst string, size int64, w io.Writer) error {
+    expected, err := digest.Parse(dgst)
     if err != nil {
         return err
     }
-    if r.StatusCode() != 200 {
-        log.Println(r.RawResponse)
-        return fmt.Errorf("can't download file from %q", r.Request.URL)
+    body, _, err := i.openBlob(dgst, 0)
+    if err != nil {
+        return err
     }
-    return nil
+    defer func() {
+        _ = body.Close()
+    }()
+    verifier := newBlobVerifier(expected, size)
+    if _, err := io.Copy(io.MultiWriter(verifier, w), body); err != nil {
+        return err
+    }
+    return verifier.verify()
 }
 
-func (i *Image) uploadBlob(digest, sourceFile string) error {
-    url, err := i.prepareUploading()
+// openBlob requests the blob from offset on and returns its body along with
+// the offset it starts at, which is 0 when the registry does not support
+// range requests and sends the whole blob.
+func (i *Image) openBlob(digest string, offset int64) (io.ReadCloser, int64, error) {
+    url := i.repositoryURL("blobs", digest)
+    r, err := i.send(resty.MethodGet, url, func(req *resty.Request) *resty.Request {
+        req = req.SetDoNotParseResponse(true)
+        if offset > 0 {
+            req = req.SetHeader("Range", fmt.Sprintf("bytes=%d-", offset))
+        }
+        return req
+    })
+    if err != nil {
+        return nil, 0, err
+    }
+    body := r.RawBody()
+    switch {
+    case r.StatusCode() == http.StatusOK:
+        return body, 0, nil
+    case r.StatusCode() == http.StatusPartialContent && offset > 0:
+        var start int64
+        if _, err := fmt.Sscanf(r.Header().Get("Content-Range"), "bytes %d-", &start); err != nil || start != offset {
+            _ = body.Close()
+            return nil, 0, fmt.Errorf("unexpected Content-Range %q for offset %d", r.Header().Get("Content-Range"), offset)
+        }
+        return body, offset, nil
+    case r.StatusCode() == http.StatusRequestedRangeNotSatisfiable && offset > 0:
+        // the partial content is not a prefix of the blob, start over
+        _ = body.Close()
+        return i.openBlob(digest, 0)
+    }
+    _ = body.Close()
+    log.Println(r.RawResponse)
+    return nil, 0, fmt.Errorf("can't download file from %q", r.Request.URL)
+}
+
+// fetchBlob downloads the blob to targetFile. The content goes to
+// targetFile.partial first and is renamed into place once verified, so that
+// targetFile only exists complete. size may be negative when unknown.
+// Downloads interrupted midway, or by an earlier run that left the partial
+// file behind, resume where they stopped when the registry supports range
+// requests.
+func (i *Image) fetchBlob(dgst string, size int64, targetFile string) error {
+    return i.fetchBlobVia(dgst, size, targetFile+".partial", targetFile)
+}
+
+// fetchBlobVia downloads the blob to targetFile as fetchBlob does, staging
+// the content in partialFile, which must be on the same file system.
+func (i *Image) fetchBlobVia(dgst string, size int64, partialFile, targetFile string) error {
+    expected, err := digest.Parse(dgst)
     if err != nil {
         return err
     }
-    f, err := os.Open(sourceFile)
+    for _, dir := range []string{filepath.Dir(partialFile), filepath.Dir(targetFile)} {
+        if err := os.MkdirAll(dir, 0755); err != nil {
+            return err
+        }
+    }
+    f, err := os.OpenFile(partialFile, os.O_RDWR|os.O_CREATE, 0644)
     if err != nil {
         return err
     }
-    defer func() {
-        _ = f.Close()
-    }()
+    err = i.fetchPartial(f, expected, size)
+    if closeErr := f.Close(); err == nil {
+        err = closeErr
+    }
+    if err != nil {
+        return err
+    }
+    return os.Rename(partialFile, targetFile)
+}
+
+// fetchPartial completes the download in f, which holds the content fetched
+// so far, and verifies it. A partial file that does not verify is removed.
+func (i *Image) fetchPartial(f *os.File, expected digest.Digest, size int64) error {
     stat, err := f.Stat()
     if err != nil {
         return err
     }
-    fSize := stat.Size()
-    start, end := 0, 0
-    buf := make([]byte, chunkSize)
-    h := sha256.New()
-    for {
-        n, err := f.Read(buf)
-        if err == io.EOF {
-            break
+    if size >= 0 && stat.Size() > size {
+        // too long to be the start of the blob
+        if err := f.Truncate(0); err != nil {
+            return err
         }
+    }
+    verifier := newBlobVerifier(expected, size)
+    // hashing what is already there leaves the file offset at its end
+    offset, err := io.Copy(verifier, f)
+    if err != nil {
+        return err
+    }
+    if offset > 0 {
+        log.Printf("resuming download of %s at %d", expected, offset)
+    }
+    for attempt := 0; size < 0 || offset < size; attempt++ {
+        body, start, err := i.openBlob(expected.String(), offset)
         if err != nil {
             return err
         }
-        end = start + n
-        log.Printf("Pushing %s ... %.2f%s", digest, (float64(end)/float64(fSize))*100, "%")
-        chunk := buf[0:n]
-        h.Write(chunk)
-        if int64(end) == fSize {
-            sum := h.Sum(nil)
-            hash := hex.EncodeToString(sum)
-            resp, err := i.Client.R().
-                SetHeader("Authorization", i.Authorization()).
-                SetHeader("Content-Type", "application/octet-stream").
-                SetHeader("Content-Length", fmt.Sprintf("%d", n)).
-                SetHeader("Content-Range", fmt.Sprintf("%d-%d", stat, end)).
-                SetQueryParam("digest", fmt.Sprintf("sha256:%s", hash)).
-                SetBody(bytes.NewBuffer(chunk)).
-                Put(url)
-            if err != nil {
+        if start != offset {
+            if err := f.Truncate(0); err != nil {
+                _ = body.Close()
                 return err
             }
-            if resp.StatusCode() != http.StatusCreated {
-                return fmt.Errorf("PUT chunk error\ncode: %d\nbody:%s", resp.StatusCode(), resp.Body())
-            }
-            break
-        } else {
-            resp, err := i.Client.R().
-                SetHeader("Authorization", i.Authorization()).
-                SetHeader("Content-Type", "application/octet-stream").
-                SetHeader("Accept-Encoding", "gzip").
-                SetHeader("Transfer-Encoding", "chunked").
-                SetHeader("Content-Length", fmt.Sprintf("%d", n)).
-                SetHeader("Content-Range", fmt.Sprintf("%d-%d", stat, end)).
-                SetBody(bytes.NewBuffer(chunk)).
-                Patch(url)
-            if err != nil {
+            if _, err := f.Seek(0, io.SeekStart); err != nil {
+                _ = body.Close()
                 return err
             }
-            location := resp.Header().Get("Location")
-            if resp.StatusCode() == http.StatusAccepted && location != "" {
-                url = location
-            } else {
-                return fmt.Errorf("PATCH chunk error\ncode: %d\nbody:%s", resp.StatusCode(), resp.Body())
-            }
-            start = end
+            verifier, offset = newBlobVerifier(expected, size), 0
+        }
+        n, err := io.Copy(io.MultiWriter(verifier, f), body)
+        _ = body.Close()
+        offset += n
+        if err == nil {
+            break
+        }
+        var mismatch *BlobMismatchError
+        if errors.As(err, &mismatch) {
+            _ = os.Remove(f.Name())
+            return err
         }
+        if attempt+1 >= downloadRetries || i.ctx != nil && i.ctx.Err() != nil {
+            return err
+        }
+        log.Printf("download of %s interrupted at %d: %v, resuming", expected, offset, err)
+    }
+    if err := verifier.verify(); err != nil {
+        _ = os.Remove(f.Name())
+        return err
     }
     return nil
 }
 
+// fetchBlobContent reads the blob into memory, verified like fetchBlobTo.
+func (i *Image) fetchBlobContent(digest string, size int64) ([]byte, error) {
+    var buf bytes.Buffer
+    if err := i.fetchBlobTo(digest, size, &buf); err != nil {
+        return nil, err
+    }
+    return buf.Bytes(), nil
+}
+
+// fetchBlobToSink writes the blob to name in sink. size may be negative when
+// the manifest does not record it.
+func (i *Image) fetchBlobToSink(sink fileSink, digest string, size int64, name string) error {
+    if dir, ok := sink.(*dirSink); ok {
+        // files on disk get resumable downloads
+        return i.fetchBlob(digest, size, dir.path(name))
+    }
+    w, err := sink.create(name, size)
+    if err != nil {
+        return err
+    }
+    if err := i.fetchBlobTo(digest, size, w); err != nil {
+        _ = w.Close()
+        return err
+    }
+    return w.Close()
+}
+
+// sinkBlob is a blob to be written to name in a fileSink, see
+// fetchBlobToSink.
+type sinkBlob struct {
+    digest string
+    size   int64
+    name   string
+}
+
+// fetchBlobsToSink downloads blobs in parallel. Sinks taking one file at a
+// time get the blobs in order, so that archives come out the same on every
+// pull: the blob whose turn it is streams straight into the sink, and only
+// those downloaded ahead of their turn wait in a temporary directory.
+func (i *Image) fetchBlobsToSink(sink fileSink, blobs []sinkBlob) error {
+    if sink.concurrent() || i.Parallelism < 2 || len(blobs) < 2 {
+        return i.parallel(len(blobs), func(image *Image, index int) error {
+            blob := blobs[index]
+            return image.fetchBlobToSink(sink, blob.digest, blob.size, blob.name)
+        })
+    }
+    dir, err := ioutil.TempDir("", "nodocker-")
+    if err != nil {
+        return err
+    }
+    defer func() {
+        _ = os.RemoveAll(dir)
+    }()
+    names := make([]string, len(blobs))
+    for index, blob := range blobs {
+        names[index] = blob.name
+    }
+    writer := newOrderedWriter(sink, &dirSink{root: dir}, names)
+    return i.parallel(len(blobs), func(image *Image, index int) error {
+        blob := blobs[index]
+        return writer.write(index, func(sink fileSink, name string) error {
+            return image.fetchBlobToSink(sink, blob.digest, blob.size, name)
+        })
+    })
+}
+
+func copyToSink(sink fileSink, file, name string) error {
+    f, err := os.Open(file)
+    if err != nil {
+        return err
+    }
+    defer func() {
+        _ = f.Close()
+    }()
+    stat, err := f.Stat()
+    if err != nil {
+        return err
+    }
+    w, err := sink.create(name, stat.Size())
+    if err != nil {
+        return err
+    }
+    if _, err := io.Copy(w, f); err != nil {
+        _ = w.Close()
+        return err
+    }
+    return w.Close()
+}
+
+// uploadBlob streams size bytes of r to the repository as blob d. Blobs up
+// to chunkSize go in a single PUT, larger ones in chunkSize PATCH requests
+// followed by a PUT with the last chunk, so that at most one chunk is held
+// in memory. The content is hashed on the way and the upload is cancelled
+// before being committed when it does not match d.
+func (i *Image) uploadBlob(d digest.Digest, r io.Reader, size int64) error {
+    session, err := i.startUpload()
+    if err != nil {
+        return err
+    }
+    verifier := d.Verifier()
+    r = io.TeeReader(io.LimitReader(r, size), verifier)
+    bufSize := int64(chunkSize)
+    if size < bufSize {
+        bufSize = size
+    }
+    buf := make([]byte, bufSize)
+    for {
+        n, err := io.ReadFull(r, buf)
+        if err != nil && err != io.EOF && err != io.ErrUnexpectedEOF {
+            session.cancel()
+            return err
+        }
+        chunk := buf[:n]
+        end := session.offset + int64(n)
+        if end < size && n == 0 {
+            session.cancel()
+            return fmt.Errorf("blob %s: expected %d bytes, got %d", d, size, end)
+        }
+        if end == size {
+            if !verifier.Verified() {
+                session.cancel()
+                return fmt.Errorf("blob digest mismatch: expected %s", d)
+            }
+            log.Printf("Pushing %s ... 100.00%%", d)
+            return session.commit(d, chunk)
+        }
+        log.Printf("Pushing %s ... %.2f%%", d, float64(end)/float64(size)*100)
+        if err := session.patch(chunk); err != nil {
+            return err
+        }
+    }
+}
+
+// cancelUpload drops an unfinished upload session, ignoring failures since
+// registries expire them anyway.
+func (i *Image) cancelUpload(url string) {
+    _, _ = i.send(resty.MethodDelete, url, func(req *resty.Request) *resty.Request {
+        return req
+    })
+}
+
 func (i *Image) prepareUploading() (string, error)  {
-    url := fmt.Sprintf("%s://%s/v2/%s/%s/blobs/uploads/", i.Scheme, i.Registry, i.Repo, i.Name)
-    resp, err := i.Client.
-        R().
-        SetHeader("Authorization", i.Authorization()).
-        Post(url)
+    url := i.repositoryURL("blobs/uploads/")
+    resp, err := i.send(resty.MethodPost, url, func(req *resty.Request) *resty.Request {
+        return req
+    })
+    if err != nil {
+        return "", err
+    }
+    location, err := locationURL(resp)
     if err != nil {
         return "", err
     }
-    location := resp.Header().Get("Location")
     if resp.StatusCode() == http.StatusAccepted && location != "" {
         return location, nil
     }
     return "", fmt.Errorf("uploads error\ncode: %d\nbody:%s", resp.StatusCode(), resp.Body())
 }
 
-func (i *Image) uploadManifest(manifest schema2.Manifest) error {
-    manifestBytes, err := json.Marshal(manifest)
-    if err != nil {
-        return err
-    }
-    resp, err := i.Client.R().
-        SetHeader("Authorization", i.Authorization()).
-        SetHeader("Content-Type", schema2.MediaTypeManifest).
-        SetBody(manifestBytes).
-        Put(fmt.Sprintf("%s://%s/v2/%s/%s/manifests/%s", i.Scheme, i.Registry, i.Repo, i.Name, i.Tag))
+// uploadManifest puts content under reference and returns its digest.
+func (i *Image) uploadManifest(reference, mediaType string, content []byte) (digest.Digest, error) {
+    manifestDigest := digest.FromBytes(content)
+    url := i.repositoryURL("manifests", reference)
+    resp, err := i.send(resty.MethodPut, url, func(req *resty.Request) *resty.Request {
+        return req.
+            SetHeader("Content-Type", mediaType).
+            SetBody(content)
+    })
     if err != nil {
-        return err
+        return "", err
     }
     if resp.StatusCode() != http.StatusCreated {
-        return fmt.Errorf("PUT manifest error\ncode: %d\nbody:%s", resp.StatusCode(), resp.Body())
+        return "", fmt.Errorf("PUT manifest error\ncode: %d\nbody:%s", resp.StatusCode(), resp.Body())
     }
-    return nil
-}
\ No newline at end of file
+    if header := resp.Header().Get("Docker-Content-Digest"); header != "" && header != manifestDigest.String() {
+        return "", fmt.Errorf("manifest digest mismatch: registry reported %s, got %s", header, manifestDigest)
+    }
+    return manifestDigest, nil
+}
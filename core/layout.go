@@ -0,0 +1,172 @@
+package core
+
+import (
+    "encoding/json"
+    "errors"
+    "fmt"
+    "io"
+    "io/ioutil"
+    "os"
+    "path"
+    "path/filepath"
+    "strings"
+
+    "github.com/opencontainers/go-digest"
+    "github.com/opencontainers/image-spec/specs-go"
+    v1 "github.com/opencontainers/image-spec/specs-go/v1"
+)
+
+const containerdImageNameAnnotation = "io.containerd.image.name"
+
+// ociLayout is an OCI image-layout directory: an oci-layout marker, an
+// index.json and content addressed blobs under blobs/<algorithm>/<encoded>.
+type ociLayout struct {
+    root  string
+    index v1.Index
+}
+
+// openOCILayout creates the layout at root, or opens it when it already
+// exists so that several pulls can share the same blobs.
+func openOCILayout(root string) (*ociLayout, error) {
+    layout := ociLayout{
+        root: root,
+        index: v1.Index{
+            Versioned: specs.Versioned{SchemaVersion: 2},
+        },
+    }
+    if err := os.MkdirAll(filepath.Join(root, "blobs", string(digest.SHA256)), 0755); err != nil {
+        return nil, err
+    }
+    layoutBytes, err := json.Marshal(v1.ImageLayout{Version: v1.ImageLayoutVersion})
+    if err != nil {
+        return nil, err
+    }
+    if err := ioutil.WriteFile(filepath.Join(root, v1.ImageLayoutFile), layoutBytes, 0644); err != nil {
+        return nil, err
+    }
+    indexBytes, err := ioutil.ReadFile(filepath.Join(root, "index.json"))
+    if err == nil {
+        if err := json.Unmarshal(indexBytes, &layout.index); err != nil {
+            return nil, err
+        }
+    } else if !os.IsNotExist(err) {
+        return nil, err
+    }
+    return &layout, nil
+}
+
+func (l *ociLayout) blobPath(d digest.Digest) string {
+    return filepath.Join(l.root, "blobs", d.Algorithm().String(), d.Encoded())
+}
+
+// partialPath is where the blob d is downloaded before being moved into
+// blobs, which only holds complete blobs.
+func (l *ociLayout) partialPath(d digest.Digest) string {
+    return filepath.Join(l.root, "ingest", d.Algorithm().String(), d.Encoded()+".partial")
+}
+
+func (l *ociLayout) hasBlob(d digest.Digest) bool {
+    _, err := os.Stat(l.blobPath(d))
+    return err == nil
+}
+
+func (l *ociLayout) writeBlob(d digest.Digest, content []byte) error {
+    if err := verifyContent(d, content); err != nil {
+        return err
+    }
+    if err := os.MkdirAll(filepath.Dir(l.blobPath(d)), 0755); err != nil {
+        return err
+    }
+    return ioutil.WriteFile(l.blobPath(d), content, 0644)
+}
+
+// addManifest records desc in index.json, replacing any entry that carries
+// the same reference name.
+func (l *ociLayout) addManifest(desc v1.Descriptor) {
+    refName := desc.Annotations[v1.AnnotationRefName]
+    manifests := l.index.Manifests[:0]
+    for _, m := range l.index.Manifests {
+        if refName != "" && m.Annotations[v1.AnnotationRefName] == refName {
+            continue
+        }
+        if refName == "" && m.Digest == desc.Digest && m.Annotations[v1.AnnotationRefName] == "" {
+            continue
+        }
+        manifests = append(manifests, m)
+    }
+    l.index.Manifests = append(manifests, desc)
+}
+
+func (l *ociLayout) writeIndex() error {
+    indexBytes, err := json.Marshal(l.index)
+    if err != nil {
+        return err
+    }
+    return ioutil.WriteFile(filepath.Join(l.root, "index.json"), indexBytes, 0644)
+}
+
+// layoutSource reads an OCI image layout out of a directory or an archive.
+type layoutSource struct {
+    source imageSource
+    index  v1.Index
+}
+
+func isOCILayout(source imageSource) bool {
+    return source.exists(v1.ImageLayoutFile)
+}
+
+func readOCILayout(source imageSource) (*layoutSource, error) {
+    if !isOCILayout(source) {
+        return nil, errors.New("not an OCI image layout")
+    }
+    indexBytes, err := readSourceFile(source, "index.json")
+    if err != nil {
+        return nil, err
+    }
+    layout := layoutSource{source: source}
+    if err := json.Unmarshal(indexBytes, &layout.index); err != nil {
+        return nil, err
+    }
+    return &layout, nil
+}
+
+func layoutBlobName(d digest.Digest) string {
+    return path.Join("blobs", d.Algorithm().String(), d.Encoded())
+}
+
+func (l *layoutSource) openBlob(d digest.Digest) (io.ReadCloser, int64, error) {
+    return l.source.open(layoutBlobName(d))
+}
+
+func (l *layoutSource) readBlob(d digest.Digest) ([]byte, error) {
+    content, err := readSourceFile(l.source, layoutBlobName(d))
+    if err != nil {
+        return nil, err
+    }
+    if err := verifyContent(d, content); err != nil {
+        return nil, err
+    }
+    return content, nil
+}
+
+// findManifest returns the index.json entry named refName, falling back to
+// the only entry tagged refName and then to the only entry of the layout.
+func (l *layoutSource) findManifest(refName string) (v1.Descriptor, error) {
+    var tagged []v1.Descriptor
+    for _, m := range l.index.Manifests {
+        name := m.Annotations[v1.AnnotationRefName]
+        if refName != "" && name == refName {
+            return m, nil
+        }
+        if refName != "" && strings.HasSuffix(name, ":"+refName) {
+            tagged = append(tagged, m)
+        }
+    }
+    if len(tagged) == 1 {
+        return tagged[0], nil
+    }
+    if len(l.index.Manifests) == 1 {
+        return l.index.Manifests[0], nil
+    }
+    return v1.Descriptor{}, fmt.Errorf("no image named %q found in layout", refName)
+}
@@ -0,0 +1,159 @@
+package core
+
+import (
+    "fmt"
+    "strings"
+
+    "github.com/docker/distribution/manifest/manifestlist"
+    v1 "github.com/opencontainers/image-spec/specs-go/v1"
+)
+
+// Platform selects which entry of a manifest list is pulled.
+type Platform struct {
+    OS           string
+    Architecture string
+    Variant      string
+    // OSVersion, when set, must match the entry's os.version exactly or be a
+    // prefix of it at a dot boundary (10.0.17763 matches 10.0.17763.1234).
+    OSVersion string
+}
+
+var DefaultPlatform = Platform{OS: "linux", Architecture: "amd64"}
+
+// ParsePlatform parses os/arch[/variant] strings such as linux/arm64/v8.
+func ParsePlatform(s string) (Platform, error) {
+    parts := strings.Split(strings.ToLower(s), "/")
+    if len(parts) < 2 || len(parts) > 3 || parts[0] == "" || parts[1] == "" {
+        return Platform{}, fmt.Errorf("error platform format: %q", s)
+    }
+    p := Platform{OS: parts[0], Architecture: parts[1]}
+    if len(parts) == 3 {
+        p.Variant = parts[2]
+    }
+    return p.normalize(), nil
+}
+
+func (p Platform) String() string {
+    s := p.OS + "/" + p.Architecture
+    if p.Variant != "" {
+        s += "/" + p.Variant
+    }
+    return s
+}
+
+// normalize maps architecture aliases to their GOARCH names and fills in the
+// default variant, so that arm64 and arm64/v8 compare equal.
+func (p Platform) normalize() Platform {
+    switch p.Architecture {
+    case "x86_64", "x86-64":
+        p.Architecture = "amd64"
+    case "aarch64":
+        p.Architecture = "arm64"
+    case "armhf":
+        p.Architecture = "arm"
+        p.Variant = "v7"
+    case "armel":
+        p.Architecture = "arm"
+        p.Variant = "v6"
+    case "i386":
+        p.Architecture = "386"
+    }
+    switch p.Architecture {
+    case "arm64":
+        if p.Variant == "" || p.Variant == "8" {
+            p.Variant = "v8"
+        }
+    case "arm":
+        if p.Variant == "" {
+            p.Variant = "v7"
+        } else if !strings.HasPrefix(p.Variant, "v") {
+            p.Variant = "v" + p.Variant
+        }
+    case "amd64":
+        if p.Variant == "v1" {
+            p.Variant = ""
+        }
+    }
+    return p
+}
+
+// variants lists the variants p can run, most preferred first.
+func (p Platform) variants() []string {
+    switch p.Architecture {
+    case "arm":
+        var variants []string
+        for _, v := range []string{"v8", "v7", "v6", "v5"} {
+            if v <= p.Variant {
+                variants = append(variants, v)
+            }
+        }
+        return variants
+    case "amd64":
+        var variants []string
+        for _, v := range []string{"v4", "v3", "v2"} {
+            if p.Variant != "" && v <= p.Variant {
+                variants = append(variants, v)
+            }
+        }
+        return append(variants, "")
+    default:
+        return []string{p.Variant}
+    }
+}
+
+func (p Platform) matchOSVersion(osVersion string) bool {
+    if p.OSVersion == "" || p.OSVersion == osVersion {
+        return true
+    }
+    return strings.HasPrefix(osVersion, p.OSVersion+".")
+}
+
+// selectPlatform returns the index of the manifest that best matches p, or -1
+// if none of them can run on it.
+func selectPlatform(p Platform, manifests []manifestlist.ManifestDescriptor) int {
+    p = p.normalize()
+    for _, variant := range p.variants() {
+        for index, m := range manifests {
+            candidate := Platform{
+                OS:           m.Platform.OS,
+                Architecture: m.Platform.Architecture,
+                Variant:      m.Platform.Variant,
+            }.normalize()
+            if candidate.OS == p.OS &&
+                candidate.Architecture == p.Architecture &&
+                candidate.Variant == variant &&
+                p.matchOSVersion(m.Platform.OSVersion) {
+                return index
+            }
+        }
+    }
+    return -1
+}
+
+// selectPlatforms returns the manifests matching any of platforms, in list
+// order, or every manifest when platforms is empty.
+func selectPlatforms(platforms []Platform, manifests []manifestlist.ManifestDescriptor) []manifestlist.ManifestDescriptor {
+    if len(platforms) == 0 {
+        return manifests
+    }
+    var selected []manifestlist.ManifestDescriptor
+    for index, m := range manifests {
+        for _, p := range platforms {
+            if selectPlatform(p, manifests) == index {
+                selected = append(selected, m)
+                break
+            }
+        }
+    }
+    return selected
+}
+
+func ociPlatform(p manifestlist.PlatformSpec) *v1.Platform {
+    return &v1.Platform{
+        Architecture: p.Architecture,
+        OS:           p.OS,
+        OSVersion:    p.OSVersion,
+        OSFeatures:   p.OSFeatures,
+        Variant:      p.Variant,
+    }
+}
@@ -1,48 +1,69 @@
 package core
 
 import (
+    "bytes"
     "encoding/json"
     "errors"
     "fmt"
-    "io/ioutil"
-    "os"
-    "path/filepath"
+    "io"
+    "net/http"
+    "path"
     "strings"
 
+    "github.com/docker/distribution"
     "github.com/docker/distribution/manifest/manifestlist"
     "github.com/docker/distribution/manifest/schema2"
+    "github.com/go-resty/resty/v2"
+    "github.com/opencontainers/go-digest"
+    v1 "github.com/opencontainers/image-spec/specs-go/v1"
 )
 
-
 func (i *Image) pull(directory string) error {
     if err := i.auth("pull"); err != nil {
         return err
     }
-    url := fmt.Sprintf("%s://%s/v2/%s/%s/manifests/%s", i.Scheme, i.Registry, i.Repo, i.Name, i.Tag)
-    resp, err := i.Client.
-        R().
-        SetHeader("Authorization", i.Authorization()).
-        SetHeader("Accept", strings.Join(acceptHeaders, ", ")).
-        SetHeader("Accept-Encoding", "gzip").
-        SetHeader("User-Agent", "docker/19.03.12 go/go1.13.10 git-commit/48a66213fe kernel/4.19.76-linuxkit os/linux arch/amd64 UpstreamClient(Docker-Client/19.03.12 \\(darwin\\))").
-        Get(url)
+    manifestBlob, err := i.fetchManifest(i.manifestReference(), acceptHeaders...)
     if err != nil {
         return err
     }
-    imageId := ""
-    if resp.StatusCode() != 200 {
-        return fmt.Errorf("request manifest error: %s", string(resp.Body()))
+    i.ManifestDigest = manifestBlob.digest
+    if i.OutputFormat == OutputFormatOCI {
+        return i.pullLayout(directory, manifestBlob)
+    }
+    return i.pullDocker(&dirSink{root: i.TargetPath(directory)}, manifestBlob)
+}
+
+// pullArchive streams the image into w as a docker-save tarball.
+func (i *Image) pullArchive(w io.Writer) error {
+    if err := i.auth("pull"); err != nil {
+        return err
+    }
+    manifestBlob, err := i.fetchManifest(i.manifestReference(), acceptHeaders...)
+    if err != nil {
+        return err
+    }
+    i.ManifestDigest = manifestBlob.digest
+    sink := newTarSink(w)
+    if err := i.pullDocker(sink, manifestBlob); err != nil {
+        return err
     }
-    typeHeader := resp.Header().Get("Content-Type")
-    switch typeHeader {
+    return sink.close()
+}
+
+// pullDocker writes the image described by manifestBlob in docker-save
+// format into sink.
+func (i *Image) pullDocker(sink fileSink, manifestBlob *manifestBlob) error {
+    imageId := ""
+    switch manifestBlob.mediaType {
     case "application/vnd.docker.distribution.manifest.v1+prettyjws":
         fallthrough
     case "application/vnd.docker.distribution.manifest.v1+json":
         var manifest ManifestV1
-        if err := json.Unmarshal(resp.Body(), &manifest); err != nil {
+        if err := json.Unmarshal(manifestBlob.content, &manifest); err != nil {
             return err
         }
         imageId = manifest.History[0].Id
+        var blobs []sinkBlob
         for index := range manifest.FSLayers {
             imageJson := manifest.History[index]
             var layer ManifestLayer
@@ -51,162 +72,358 @@ func (i *Image) pull(directory string) error {
             }
             layerId := layer.Id
             imageLayer := manifest.FSLayers[index].BlobSum
-            layerPath := filepath.Join(directory, i.Registry, i.Repo, i.Name, layerId)
-            if _, err := os.Stat(layerPath); os.IsNotExist(err) {
-                if err := os.MkdirAll(layerPath, 0700); err != nil {
-                    return err
-                }
-            }
-            if err := ioutil.WriteFile(filepath.Join(layerPath, "VERSION"), []byte("1.0"), 0755); err != nil {
+            if err := sink.writeFile(path.Join(layerId, "VERSION"), []byte("1.0")); err != nil {
                 return err
             }
-            if err := ioutil.WriteFile(filepath.Join(layerPath, "json"), []byte(imageJson.V1Compatibility), 0755); err != nil {
-                return err
-            }
-            if err := i.fetchBlob(imageLayer, filepath.Join(layerPath, "layer.tar")); err != nil {
+            if err := sink.writeFile(path.Join(layerId, "json"), []byte(imageJson.V1Compatibility)); err != nil {
                 return err
             }
+            blobs = append(blobs, sinkBlob{digest: imageLayer, size: -1, name: path.Join(layerId, "layer.tar")})
             imageId = layerId
         }
+        if err := i.fetchBlobsToSink(sink, blobs); err != nil {
+            return err
+        }
         break
-    case "application/vnd.docker.distribution.manifest.v2+json":
+    case "application/vnd.docker.distribution.manifest.v2+json", v1.MediaTypeImageManifest:
         var manifest schema2.Manifest
-        if err := json.Unmarshal(resp.Body(), &manifest); err != nil {
+        if err := json.Unmarshal(manifestBlob.content, &manifest); err != nil {
             return err
         }
-        if err := i.handleManifestV2(&manifest, directory); err != nil {
+        if err := i.handleManifestV2(&manifest, sink); err != nil {
             return err
         }
         break
-    case "application/vnd.docker.distribution.manifest.list.v2+json":
+    case "application/vnd.docker.distribution.manifest.list.v2+json", v1.MediaTypeImageIndex:
         var manifestList manifestlist.ManifestList
-        if err := json.Unmarshal(resp.Body(), &manifestList); err != nil {
+        if err := json.Unmarshal(manifestBlob.content, &manifestList); err != nil {
             return err
         }
-        var digest string
-        for _, m := range manifestList.Manifests {
-            if m.Platform.Architecture == targetArch && m.Platform.OS == targetOS {
-                digest = m.Digest.String()
-                break
-            }
-        }
-        if digest == "" {
-            return errors.New("no match platform image digest found")
+        index := selectPlatform(i.Platform, manifestList.Manifests)
+        if index < 0 {
+            return fmt.Errorf("no image found for platform %s", i.Platform)
         }
-        manifest, err := i.fetchManifestV2(digest)
+        manifest, err := i.fetchManifestV2(manifestList.Manifests[index].Digest.String())
         if err != nil {
             return err
         }
-        if err := i.handleManifestV2(manifest, directory); err != nil {
+        if err := i.handleManifestV2(manifest, sink); err != nil {
             return err
         }
         break
     default:
-        return fmt.Errorf("unsupported ContentType %s", typeHeader)
+        return fmt.Errorf("unsupported ContentType %s", manifestBlob.mediaType)
+    }
+    if i.Tag == "" {
+        return nil
     }
     repositoriesBytes := []byte(fmt.Sprintf("{\n\"%s\": { \"%s\": \"%s\" }\n}", i.Name, i.Tag, imageId))
-    repositoriesPath := filepath.Join(directory, i.Registry, i.Repo, i.Name, "repositories")
-    return ioutil.WriteFile(repositoriesPath, repositoriesBytes, 0644)
+    return sink.writeFile("repositories", repositoriesBytes)
 }
 
+// fetchManifest requests the manifest identified by reference, which is either
+// a tag or a digest. Manifests requested by digest are verified against it
+// before being returned.
+func (i *Image) fetchManifest(reference string, accept ...string) (*manifestBlob, error) {
+    url := i.repositoryURL("manifests", reference)
+    resp, err := i.send(resty.MethodGet, url, func(req *resty.Request) *resty.Request {
+        return req.
+            SetHeader("Accept", strings.Join(accept, ", ")).
+            SetHeader("Accept-Encoding", "gzip").
+            SetHeader("User-Agent", "docker/19.03.12 go/go1.13.10 git-commit/48a66213fe kernel/4.19.76-linuxkit os/linux arch/amd64 UpstreamClient(Docker-Client/19.03.12 \\(darwin\\))")
+    })
+    if err != nil {
+        return nil, err
+    }
+    if resp.StatusCode() != http.StatusOK {
+        return nil, fmt.Errorf("request manifest error: %s", string(resp.Body()))
+    }
+    blob := manifestBlob{
+        mediaType: manifestMediaType(resp.Header().Get("Content-Type"), resp.Body()),
+        content:   resp.Body(),
+    }
+    if expected, err := digest.Parse(reference); err == nil {
+        if err := verifyContent(expected, blob.content); err != nil {
+            return nil, err
+        }
+        blob.digest = expected
+    } else {
+        blob.digest = digest.FromBytes(blob.content)
+    }
+    // signed schema1 manifests are digested without their signatures
+    header := resp.Header().Get("Docker-Content-Digest")
+    if header != "" && header != blob.digest.String() && !strings.HasSuffix(blob.mediaType, "+prettyjws") {
+        return nil, fmt.Errorf("manifest digest mismatch: registry reported %s, got %s", header, blob.digest)
+    }
+    return &blob, nil
+}
+
+// fetchManifestV2 fetches a schema2 or OCI image manifest. Both share the
+// same config and layers layout, so OCI manifests decode into schema2.Manifest.
 func (i *Image) fetchManifestV2(digest string) (*schema2.Manifest, error) {
-    url := fmt.Sprintf("%s://%s/v2/%s/%s/manifests/%s", i.Scheme, i.Registry, i.Repo, i.Name, digest)
-    resp, err := i.Client.
-        R().
-        SetHeader("Authorization", fmt.Sprintf("Bearer %s", i.AuthInfo.Token)).
-        SetHeader("Accept", "application/vnd.docker.distribution.manifest.v2+json").
-        Get(url)
+    blob, err := i.fetchManifest(digest, schema2.MediaTypeManifest, v1.MediaTypeImageManifest)
     if err != nil {
         return nil, err
     }
+    if !isImageManifest(blob.mediaType) {
+        return nil, fmt.Errorf("unsupported ContentType %s", blob.mediaType)
+    }
     var manifest schema2.Manifest
-    if err := json.Unmarshal(resp.Body(), &manifest); err != nil {
+    if err := json.Unmarshal(blob.content, &manifest); err != nil {
         return nil, err
     }
-    return &manifest, err
+    return &manifest, nil
 }
 
-func (i *Image) handleManifestV2(manifest *schema2.Manifest, directory string) error {
+func (i *Image) handleManifestV2(manifest *schema2.Manifest, sink fileSink) error {
     var layers []string
     configDigest := manifest.Config.Digest
     imageId := strings.TrimPrefix(configDigest.Encoded(), "sha256:")
-    imageConfigPath := filepath.Join(directory, i.Registry, i.Repo, i.Name, fmt.Sprintf("%s.json", imageId))
-    if err := i.fetchBlob(configDigest.String(), imageConfigPath); err != nil {
+    imageConfigBytes, err := i.fetchBlobContent(configDigest.String(), manifest.Config.Size)
+    if err != nil {
         return err
     }
+    if err := sink.writeFile(fmt.Sprintf("%s.json", imageId), imageConfigBytes); err != nil {
+        return err
+    }
+    var layerIds []string
+    var blobs []sinkBlob
     parentId := ""
-    originParentId := ""
-    for index := range manifest.Layers {
-        layer := manifest.Layers[index]
-        layerMediaType := layer.MediaType
-        layerDigest := layer.Digest
-        layerId := hashSha256(fmt.Sprintf(`%s\n%s\n`, parentId, layerDigest))
-        layerDir := filepath.Join(directory, i.Registry, i.Repo, i.Name, layerId)
-        if _, err := os.Stat(layerDir); os.IsNotExist(err) {
-            if err := os.MkdirAll(layerDir, 0700); err != nil {
-                return err
-            }
+    for _, layer := range manifest.Layers {
+        layerId := hashSha256(fmt.Sprintf(`%s\n%s\n`, parentId, layer.Digest))
+        layerIds = append(layerIds, layerId)
+        parentId = layerId
+    }
+    for index, layer := range manifest.Layers {
+        layerId := layerIds[index]
+        parentId := ""
+        if index > 0 {
+            parentId = layerIds[index-1]
         }
-        if err := ioutil.WriteFile(filepath.Join(layerDir, "VERSION"), []byte("1.0"), 0755); err != nil {
+        if err := sink.writeFile(path.Join(layerId, "VERSION"), []byte("1.0")); err != nil {
             return err
         }
-        layerJsonPath := filepath.Join(layerDir, "json")
-        if _, err := os.Stat(layerJsonPath); os.IsNotExist(err) {
-            f, err := os.Create(layerJsonPath)
+        layerJsonPath := path.Join(layerId, "json")
+        if index == len(manifest.Layers)-1 {
+            // the top layer carries the image config
+            var imageConfigJson map[string]interface{}
+            if err := json.Unmarshal(imageConfigBytes, &imageConfigJson); err != nil {
+                return err
+            }
+            imageConfigJson["id"] = layerId
+            if parentId != "" {
+                imageConfigJson["parentId"] = parentId
+            }
+            lastLayerJsonBytes, err := json.Marshal(imageConfigJson)
             if err != nil {
                 return err
             }
-            if err := layerJsonTemplate(layerId, parentId, f); err != nil {
-                _ = f.Close()
+            if err := sink.writeFile(layerJsonPath, lastLayerJsonBytes); err != nil {
+                return err
+            }
+        } else if !sink.exists(layerJsonPath) {
+            var layerJson bytes.Buffer
+            if err := layerJsonTemplate(layerId, parentId, &layerJson); err != nil {
+                return err
+            }
+            if err := sink.writeFile(layerJsonPath, layerJson.Bytes()); err != nil {
                 return err
             }
-            _ = f.Close()
         }
-        switch layerMediaType {
-        case "application/vnd.docker.image.rootfs.diff.tar.gzip":
-            layerTar := filepath.Join(layerDir, "layer.tar")
-            if _, err := os.Stat(layerTar); os.IsNotExist(err) {
-                if err := i.fetchBlob(layerDigest.String(), layerTar); err != nil {
-                    return err
-                }
+        switch layer.MediaType {
+        case "application/vnd.docker.image.rootfs.diff.tar.gzip",
+            v1.MediaTypeImageLayer,
+            v1.MediaTypeImageLayerGzip,
+            mediaTypeImageLayerZstd:
+            layerTar := path.Join(layerId, "layer.tar")
+            if !sink.exists(layerTar) {
+                blobs = append(blobs, sinkBlob{digest: layer.Digest.String(), size: layer.Size, name: layerTar})
             }
-            layers = append(layers, filepath.Join(layerId, "layer.tar"))
+            layers = append(layers, layerTar)
         }
-        originParentId = parentId
-        parentId = layerId
     }
-    lastLayerId := parentId
-    parentId = originParentId
-    imageConfigBytes, err := ioutil.ReadFile(imageConfigPath)
+    if len(layerIds) == 0 {
+        return errors.New("image has no layers")
+    }
+    if err := i.fetchBlobsToSink(sink, blobs); err != nil {
+        return err
+    }
+    var imageManifest []LocalManifest
+    imageManifest = append(imageManifest, LocalManifest{
+        Config: path.Join(layerIds[len(layerIds)-1], "json"),
+        RepoTags: i.repoTags(),
+        Layers: layers,
+    })
+    imageManifestBytes, err := json.Marshal(imageManifest)
     if err != nil {
         return err
     }
-    var imageConfigJson map[string]interface{}
-    if err := json.Unmarshal(imageConfigBytes, &imageConfigJson); err != nil {
+    return sink.writeFile("manifest.json", imageManifestBytes)
+}
+
+// pullLayout saves the image, resolved to i.Platform when it is a manifest
+// list, into the OCI image layout at directory.
+func (i *Image) pullLayout(directory string, rootBlob *manifestBlob) error {
+    layout, err := openOCILayout(directory)
+    if err != nil {
         return err
     }
-    imageConfigJson["id"] = lastLayerId
-    if parentId != "" {
-        imageConfigJson["parentId"] = parentId
+    blob := rootBlob
+    var platform *v1.Platform
+    if isManifestList(rootBlob.mediaType) {
+        var manifestList manifestlist.ManifestList
+        if err := json.Unmarshal(rootBlob.content, &manifestList); err != nil {
+            return err
+        }
+        index := selectPlatform(i.Platform, manifestList.Manifests)
+        if index < 0 {
+            return fmt.Errorf("no image found for platform %s", i.Platform)
+        }
+        m := manifestList.Manifests[index]
+        blob, err = i.fetchManifest(m.Digest.String(), m.MediaType)
+        if err != nil {
+            return err
+        }
+        platform = ociPlatform(m.Platform)
+    }
+    if err := i.pullToLayout(layout, blob); err != nil {
+        return err
+    }
+    layout.addManifest(v1.Descriptor{
+        MediaType:   blob.mediaType,
+        Digest:      blob.digest,
+        Size:        int64(len(blob.content)),
+        Annotations: i.layoutAnnotations(blob.digest),
+        Platform:    platform,
+    })
+    return layout.writeIndex()
+}
+
+// pullPlatforms saves the platforms of a manifest list that match platforms,
+// or all of them when platforms is empty, into the OCI image layout at
+// directory.
+func (i *Image) pullPlatforms(directory string, platforms []Platform) error {
+    if err := i.auth("pull"); err != nil {
+        return err
     }
-    lastLayerJsonBytes, err := json.Marshal(imageConfigJson)
+    layout, err := openOCILayout(directory)
     if err != nil {
         return err
     }
-    lastLayerPath := filepath.Join(directory, i.Registry, i.Repo, i.Name, lastLayerId, "json")
-    if err := ioutil.WriteFile(lastLayerPath, lastLayerJsonBytes, 0644); err != nil {
+    rootBlob, err := i.fetchManifest(i.manifestReference(), acceptHeaders...)
+    if err != nil {
         return err
     }
-    var imageManifest []LocalManifest
-    imageManifest = append(imageManifest, LocalManifest{
-        Config: filepath.Join(lastLayerId, "json"),
-        RepoTags: []string{fmt.Sprintf("%s:%s", i.Name, i.Tag)},
-        Layers: layers,
-    })
-    imageManifestBytes, err := json.Marshal(imageManifest)
+    i.ManifestDigest = rootBlob.digest
+    desc := v1.Descriptor{
+        MediaType: rootBlob.mediaType,
+        Digest:    rootBlob.digest,
+        Size:      int64(len(rootBlob.content)),
+    }
+    switch rootBlob.mediaType {
+    case schema2.MediaTypeManifest, v1.MediaTypeImageManifest:
+        if len(platforms) > 0 {
+            platform, err := i.fetchConfigPlatform(rootBlob)
+            if err != nil {
+                return err
+            }
+            if len(selectPlatforms(platforms, []manifestlist.ManifestDescriptor{{Platform: *platform}})) == 0 {
+                return fmt.Errorf("no image found for platforms %v", platforms)
+            }
+        }
+        if err := i.pullToLayout(layout, rootBlob); err != nil {
+            return err
+        }
+    case manifestlist.MediaTypeManifestList, v1.MediaTypeImageIndex:
+        var manifestList manifestlist.ManifestList
+        if err := json.Unmarshal(rootBlob.content, &manifestList); err != nil {
+            return err
+        }
+        selected := selectPlatforms(platforms, manifestList.Manifests)
+        if len(selected) == 0 {
+            return fmt.Errorf("no image found for platforms %v", platforms)
+        }
+        var index v1.Index
+        index.SchemaVersion = 2
+        for _, m := range selected {
+            blob, err := i.fetchManifest(m.Digest.String(), m.MediaType)
+            if err != nil {
+                return err
+            }
+            if err := i.pullToLayout(layout, blob); err != nil {
+                return err
+            }
+            index.Manifests = append(index.Manifests, v1.Descriptor{
+                MediaType: m.MediaType,
+                Digest:    m.Digest,
+                Size:      m.Size,
+                Platform:  ociPlatform(m.Platform),
+            })
+        }
+        // the original list is kept when nothing was filtered out, so the
+        // layout still resolves to the digest the registry served
+        if len(selected) < len(manifestList.Manifests) {
+            indexBytes, err := json.Marshal(index)
+            if err != nil {
+                return err
+            }
+            rootBlob = &manifestBlob{
+                mediaType: v1.MediaTypeImageIndex,
+                digest:    digest.FromBytes(indexBytes),
+                content:   indexBytes,
+            }
+            desc.MediaType = rootBlob.mediaType
+            desc.Digest = rootBlob.digest
+            desc.Size = int64(len(indexBytes))
+        }
+        if err := layout.writeBlob(rootBlob.digest, rootBlob.content); err != nil {
+            return err
+        }
+    default:
+        return fmt.Errorf("unsupported ContentType %s", rootBlob.mediaType)
+    }
+    desc.Annotations = i.layoutAnnotations(desc.Digest)
+    layout.addManifest(desc)
+    return layout.writeIndex()
+}
+
+// fetchConfigPlatform reads the platform of an image manifest from its
+// config.
+func (i *Image) fetchConfigPlatform(blob *manifestBlob) (*manifestlist.PlatformSpec, error) {
+    var manifest schema2.Manifest
+    if err := json.Unmarshal(blob.content, &manifest); err != nil {
+        return nil, err
+    }
+    config, err := i.fetchBlobContent(manifest.Config.Digest.String(), manifest.Config.Size)
     if err != nil {
+        return nil, err
+    }
+    return parseConfigPlatform(config, manifest.Config.Digest.String())
+}
+
+// pullToLayout stores an image manifest together with its config and layers
+// in layout. Blobs already present are not downloaded again.
+func (i *Image) pullToLayout(layout *ociLayout, blob *manifestBlob) error {
+    if !isImageManifest(blob.mediaType) {
+        return fmt.Errorf("unsupported ContentType %s", blob.mediaType)
+    }
+    var manifest schema2.Manifest
+    if err := json.Unmarshal(blob.content, &manifest); err != nil {
         return err
     }
-    imageManifestPath := filepath.Join(directory, i.Registry, i.Repo, i.Name, "manifest.json")
-    return ioutil.WriteFile(imageManifestPath, imageManifestBytes, 0644)
-}
\ No newline at end of file
+    var missing []distribution.Descriptor
+    seen := map[digest.Digest]bool{}
+    for _, desc := range append([]distribution.Descriptor{manifest.Config}, manifest.Layers...) {
+        if !layout.hasBlob(desc.Digest) && !seen[desc.Digest] {
+            seen[desc.Digest] = true
+            missing = append(missing, desc)
+        }
+    }
+    if err := i.parallel(len(missing), func(image *Image, index int) error {
+        desc := missing[index]
+        return image.fetchBlobVia(desc.Digest.String(), desc.Size, layout.partialPath(desc.Digest), layout.blobPath(desc.Digest))
+    }); err != nil {
+        return err
+    }
+    return layout.writeBlob(blob.digest, blob.content)
+}
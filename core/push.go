@@ -4,98 +4,582 @@ import (
     "encoding/json"
     "errors"
     "fmt"
-    "io/ioutil"
+    "io"
     "log"
     "net/http"
-    "path/filepath"
+    "path"
 
     "github.com/docker/distribution"
+    "github.com/docker/distribution/manifest/manifestlist"
+    "github.com/docker/distribution/manifest/ocischema"
     "github.com/docker/distribution/manifest/schema2"
+    "github.com/go-resty/resty/v2"
     "github.com/opencontainers/go-digest"
+    v1 "github.com/opencontainers/image-spec/specs-go/v1"
 )
 
-func (i *Image) push(directory string) error {
-    if err := i.auth("push,pull"); err != nil {
+func (i *Image) push(file string) error {
+    if err := i.preparePush(); err != nil {
         return err
     }
-    resp, err := i.Client.
-        R().
-        SetHeader("Authorization", i.Authorization()).
-        Post(fmt.Sprintf("%s://%s/v2/%s/%s/blobs/uploads/", i.Scheme, i.Registry, i.Repo, i.Name))
+    source, err := openSource(file)
     if err != nil {
         return err
     }
-    if resp.StatusCode() == http.StatusUnauthorized {
-        return errors.New("unauthorized push request")
+    defer func() {
+        _ = source.close()
+    }()
+    if !source.exists("manifest.json") && isOCILayout(source) {
+        return i.pushLayout(source)
     }
-    manifestFilePath := filepath.Join(directory, "manifest.json")
-    manifestFile, err := ioutil.ReadFile(manifestFilePath)
+    manifest, err := readLocalManifest(source)
     if err != nil {
         return err
     }
-    var manifests []LocalManifest
-    if err := json.Unmarshal(manifestFile, &manifests); err != nil {
+    blob, err := i.pushLocalImage(source, manifest)
+    if err != nil {
+        return err
+    }
+    return i.putManifest(blob)
+}
+
+// pushRepoTags pushes each entry of manifest.json to every one of its tags,
+// uploading shared layers only once per repository.
+func (i *Image) pushRepoTags(file, prefix string) error {
+    source, err := openSource(file)
+    if err != nil {
+        return err
+    }
+    defer func() {
+        _ = source.close()
+    }()
+    manifests, err := readLocalManifests(source)
+    if err != nil {
+        return err
+    }
+    names, err := rewriteRepoTags(manifests, prefix)
+    if err != nil {
         return err
     }
-    manifest := manifests[0]
-    newManifest := schema2.Manifest{}
-    for _, layer := range manifest.Layers {
-        layerPath := filepath.Join(directory, layer)
-        layerFile, err := ioutil.ReadFile(layerPath)
+    for index, manifest := range manifests {
+        if len(manifest.RepoTags) == 0 {
+            log.Printf("image %s has no tags, skipped", manifest.Config)
+            continue
+        }
+        for _, name := range names[index] {
+            image, err := i.withReference(name)
+            if err != nil {
+                return err
+            }
+            if err := image.prepareAuth(); err != nil {
+                return err
+            }
+            if err := image.preparePush(); err != nil {
+                return err
+            }
+            blob, err := image.pushLocalImage(source, manifest)
+            if err != nil {
+                return err
+            }
+            if err := image.putManifest(blob); err != nil {
+                return err
+            }
+            log.Printf("pushed %s", name)
+        }
+    }
+    return nil
+}
+
+// pushPlatforms pushes one local image per file by digest and then tags a
+// manifest list, or an OCI index for ManifestFormatOCI, referencing all of
+// them. The platform of each image is read from its config.
+func (i *Image) pushPlatforms(files []string) error {
+    if err := i.preparePush(); err != nil {
+        return err
+    }
+    var descriptors []manifestlist.ManifestDescriptor
+    for _, file := range files {
+        blob, platform, err := i.pushPlatform(file)
         if err != nil {
             return err
         }
-        layerHash := hashSha256(string(layerFile))
-        exist, err := i.checkLayerExist(layerHash)
+        if _, err := i.uploadManifest(blob.digest.String(), blob.mediaType, blob.content); err != nil {
+            return err
+        }
+        descriptors = append(descriptors, manifestlist.ManifestDescriptor{
+            Descriptor: distribution.Descriptor{
+                MediaType: blob.mediaType,
+                Size:      int64(len(blob.content)),
+                Digest:    blob.digest,
+            },
+            Platform: *platform,
+        })
+    }
+    var mediaType string
+    var payload []byte
+    switch i.ManifestFormat {
+    case ManifestFormatOCI:
+        index := v1.Index{
+            Annotations: i.Annotations,
+        }
+        index.SchemaVersion = 2
+        for _, d := range descriptors {
+            index.Manifests = append(index.Manifests, v1.Descriptor{
+                MediaType: d.MediaType,
+                Digest:    d.Digest,
+                Size:      d.Size,
+                Platform:  ociPlatform(d.Platform),
+            })
+        }
+        content, err := json.Marshal(index)
         if err != nil {
             return err
         }
-        if exist {
-            log.Printf("layer: %s exist", layerHash)
-        } else {
-            if err := i.uploadBlob(layerHash, layerPath); err != nil {
-                return err
-            }
+        mediaType, payload = v1.MediaTypeImageIndex, content
+    default:
+        manifestList, err := manifestlist.FromDescriptors(descriptors)
+        if err != nil {
+            return err
         }
-        newManifest.Layers = append(newManifest.Layers, distribution.Descriptor{
-            MediaType: schema2.MediaTypeLayer,
-            Size: getFileSize(layerPath),
-            Digest: digest.Digest("sha256:" + layerHash),
-        })
+        mediaType, payload, err = manifestList.Payload()
+        if err != nil {
+            return err
+        }
+    }
+    return i.putManifest(&manifestBlob{
+        mediaType: mediaType,
+        digest:    digest.FromBytes(payload),
+        content:   payload,
+    })
+}
+
+func (i *Image) pushPlatform(file string) (*manifestBlob, *manifestlist.PlatformSpec, error) {
+    source, err := openSource(file)
+    if err != nil {
+        return nil, nil, err
     }
-    configPath := filepath.Join(directory, manifest.Config)
-    configFile, err := ioutil.ReadFile(configPath)
+    defer func() {
+        _ = source.close()
+    }()
+    manifest, err := readLocalManifest(source)
     if err != nil {
+        return nil, nil, err
+    }
+    platform, err := readConfigPlatform(source, manifest.Config)
+    if err != nil {
+        return nil, nil, err
+    }
+    blob, err := i.pushLocalImage(source, manifest)
+    if err != nil {
+        return nil, nil, err
+    }
+    return blob, platform, nil
+}
+
+func (i *Image) preparePush() error {
+    if err := i.auth("push,pull"); err != nil {
         return err
     }
-    configHash := hashSha256(string(configFile))
-    exist, err := i.checkLayerExist(configHash)
+    url := i.repositoryURL("blobs/uploads/")
+    resp, err := i.send(resty.MethodPost, url, func(req *resty.Request) *resty.Request {
+        return req
+    })
     if err != nil {
         return err
     }
+    if resp.StatusCode() == http.StatusUnauthorized {
+        return errors.New("unauthorized push request")
+    }
+    // the session only probes the push permission
+    if resp.StatusCode() == http.StatusAccepted {
+        if location, _ := locationURL(resp); location != "" {
+            i.cancelUpload(location)
+        }
+    }
+    return nil
+}
+
+// pushLocalImage uploads the layers and config of a docker-save style image
+// and returns the manifest describing them, without uploading it.
+func (i *Image) pushLocalImage(source imageSource, manifest LocalManifest) (*manifestBlob, error) {
+    // the layers and then the config, so that descs lines up with files
+    files := append(append([]string(nil), manifest.Layers...), manifest.Config)
+    descs := make([]distribution.Descriptor, len(files))
+    heads := make([][]byte, len(files))
+    err := i.parallel(len(files), func(image *Image, index int) error {
+        var err error
+        descs[index], heads[index], err = image.pushSourceFile(source, files[index])
+        return err
+    })
+    if err != nil {
+        return nil, err
+    }
+    layers := descs[:len(manifest.Layers)]
+    for index := range layers {
+        layers[index].MediaType = layerMediaType(i.ManifestFormat, heads[index])
+    }
+    config := descs[len(manifest.Layers)]
+    config.MediaType = schema2.MediaTypeImageConfig
+    var mediaType string
+    var manifestBytes []byte
+    switch i.ManifestFormat {
+    case ManifestFormatOCI:
+        config.MediaType = v1.MediaTypeImageConfig
+        newManifest, err := ocischema.FromStruct(ocischema.Manifest{
+            Versioned:   ocischema.SchemaVersion,
+            Config:      config,
+            Layers:      layers,
+            Annotations: i.Annotations,
+        })
+        if err != nil {
+            return nil, err
+        }
+        mediaType, manifestBytes, err = newManifest.Payload()
+        if err != nil {
+            return nil, err
+        }
+    default:
+        newManifest := schema2.Manifest{
+            Versioned: schema2.SchemaVersion,
+            Config:    config,
+            Layers:    layers,
+        }
+        mediaType = schema2.MediaTypeManifest
+        manifestBytes, err = json.Marshal(newManifest)
+        if err != nil {
+            return nil, err
+        }
+    }
+    return &manifestBlob{
+        mediaType: mediaType,
+        digest:    digest.FromBytes(manifestBytes),
+        content:   manifestBytes,
+    }, nil
+}
+
+// pushSourceFile uploads the file name of source unless the repository has
+// it, and returns its descriptor without media type along with its first
+// bytes. Files are streamed, never read into memory as a whole.
+func (i *Image) pushSourceFile(source imageSource, name string) (distribution.Descriptor, []byte, error) {
+    d, size, head, err := describeSourceFile(source, name)
+    if err != nil {
+        return distribution.Descriptor{}, nil, err
+    }
+    desc := distribution.Descriptor{
+        Size:   size,
+        Digest: d,
+    }
+    exist, err := i.blobAvailable(d.Encoded())
+    if err != nil {
+        return distribution.Descriptor{}, nil, err
+    }
     if exist {
-        log.Printf("config: %s exist", configHash)
-    } else {
-        if err := i.uploadBlob(configHash, configPath); err != nil {
+        log.Printf("blob: %s exist", d)
+        return desc, head, nil
+    }
+    r, _, err := source.open(name)
+    if err != nil {
+        return distribution.Descriptor{}, nil, err
+    }
+    defer func() {
+        _ = r.Close()
+    }()
+    if err := i.uploadBlob(d, r, size); err != nil {
+        return distribution.Descriptor{}, nil, err
+    }
+    return desc, head, nil
+}
+
+// describeSourceFile returns the digest, size and first bytes of the file
+// name of source. Files named after their digest, as in the blobs directory
+// of newer docker save archives, are trusted here and verified on upload;
+// the others are hashed in a streaming pass.
+func describeSourceFile(source imageSource, name string) (digest.Digest, int64, []byte, error) {
+    r, size, err := source.open(name)
+    if err != nil {
+        return "", 0, nil, err
+    }
+    defer func() {
+        _ = r.Close()
+    }()
+    head := make([]byte, 4)
+    n, err := io.ReadFull(r, head)
+    if err != nil && err != io.EOF && err != io.ErrUnexpectedEOF {
+        return "", 0, nil, err
+    }
+    head = head[:n]
+    if d, ok := digestFromName(name); ok {
+        return d, size, head, nil
+    }
+    digester := digest.SHA256.Digester()
+    digester.Hash().Write(head)
+    if _, err := io.Copy(digester.Hash(), r); err != nil {
+        return "", 0, nil, err
+    }
+    return digester.Digest(), size, head, nil
+}
+
+// digestFromName parses names of the form blobs/<algorithm>/<encoded>.
+func digestFromName(name string) (digest.Digest, bool) {
+    dir, encoded := path.Split(name)
+    algorithm := path.Base(dir)
+    if path.Base(path.Dir(dir)) != "blobs" {
+        return "", false
+    }
+    d := digest.NewDigestFromEncoded(digest.Algorithm(algorithm), encoded)
+    if d.Validate() != nil {
+        return "", false
+    }
+    return d, true
+}
+
+// pushLayout pushes the image of an OCI layout tagged with the image's tag,
+// or its only image. Indexes are pushed with every manifest they reference.
+func (i *Image) pushLayout(source imageSource) error {
+    layout, err := readOCILayout(source)
+    if err != nil {
+        return err
+    }
+    desc, err := layout.findManifest(i.Tag)
+    if err != nil {
+        return err
+    }
+    blob, err := i.pushLayoutManifest(layout, desc)
+    if err != nil {
+        return err
+    }
+    return i.putManifest(blob)
+}
+
+// pushLayoutManifest uploads everything desc references and returns the
+// manifest itself, which the caller uploads under the reference it needs.
+func (i *Image) pushLayoutManifest(layout *layoutSource, desc v1.Descriptor) (*manifestBlob, error) {
+    content, err := layout.readBlob(desc.Digest)
+    if err != nil {
+        return nil, err
+    }
+    switch desc.MediaType {
+    case manifestlist.MediaTypeManifestList, v1.MediaTypeImageIndex:
+        var index v1.Index
+        if err := json.Unmarshal(content, &index); err != nil {
+            return nil, err
+        }
+        for _, m := range index.Manifests {
+            blob, err := i.pushLayoutManifest(layout, m)
+            if err != nil {
+                return nil, err
+            }
+            if _, err := i.uploadManifest(blob.digest.String(), blob.mediaType, blob.content); err != nil {
+                return nil, err
+            }
+        }
+    case schema2.MediaTypeManifest, v1.MediaTypeImageManifest:
+        var manifest v1.Manifest
+        if err := json.Unmarshal(content, &manifest); err != nil {
+            return nil, err
+        }
+        var blobs []digest.Digest
+        for _, blob := range append([]v1.Descriptor{manifest.Config}, manifest.Layers...) {
+            if !containsDigest(blobs, blob.Digest) {
+                blobs = append(blobs, blob.Digest)
+            }
+        }
+        if err := i.parallel(len(blobs), func(image *Image, index int) error {
+            exist, err := image.blobAvailable(blobs[index].Encoded())
+            if err != nil {
+                return err
+            }
+            if exist {
+                log.Printf("blob: %s exist", blobs[index])
+                return nil
+            }
+            return image.uploadLayoutBlob(layout, blobs[index])
+        }); err != nil {
+            return nil, err
+        }
+    default:
+        return nil, fmt.Errorf("unsupported ContentType %s", desc.MediaType)
+    }
+    return &manifestBlob{
+        mediaType: desc.MediaType,
+        digest:    desc.Digest,
+        content:   content,
+    }, nil
+}
+
+func (i *Image) uploadLayoutBlob(layout *layoutSource, d digest.Digest) error {
+    r, size, err := layout.openBlob(d)
+    if err != nil {
+        return err
+    }
+    defer func() {
+        _ = r.Close()
+    }()
+    return i.uploadBlob(d, r, size)
+}
+
+// putManifest uploads blob under the image's tag, or under its digest for
+// digest-only references, after checking it against a pinned digest.
+func (i *Image) putManifest(blob *manifestBlob) error {
+    if i.Digest != "" {
+        if err := verifyContent(i.Digest, blob.content); err != nil {
             return err
         }
     }
-    newManifest.Config.MediaType = schema2.MediaTypeImageConfig
-    newManifest.Config.Size = getFileSize(configPath)
-    newManifest.Config.Digest = digest.Digest("sha256:" + configHash)
-    newManifest.SchemaVersion = schema2.SchemaVersion.SchemaVersion
-    newManifest.MediaType = schema2.SchemaVersion.MediaType
-    if err := i.uploadManifest(newManifest); err != nil {
+    reference := i.Tag
+    if reference == "" {
+        reference = i.Digest.String()
+    }
+    manifestDigest, err := i.uploadManifest(reference, blob.mediaType, blob.content)
+    if err != nil {
         return err
     }
+    i.ManifestDigest = manifestDigest
     return nil
 }
 
 func (i *Image) checkLayerExist(layerId string) (bool, error) {
-    url := fmt.Sprintf("%s://%s/v2/%s/%s/blobs/sha256:%s/", i.Scheme, i.Registry, i.Repo, i.Name, layerId)
-    resp, err := i.Client.R().SetHeader("Authorization", i.Authorization()).Head(url)
+    url := i.repositoryURL("blobs", "sha256:"+layerId)
+    resp, err := i.send(resty.MethodHead, url, func(req *resty.Request) *resty.Request {
+        return req
+    })
     if err != nil {
         return false, err
     }
     return resp.StatusCode() != http.StatusNotFound, nil
-}
\ No newline at end of file
+}
+
+// blobAvailable reports whether the repository has the blob, mounting it
+// from one of the MountFrom repositories when it does not.
+func (i *Image) blobAvailable(layerId string) (bool, error) {
+    exist, err := i.checkLayerExist(layerId)
+    if err != nil || exist {
+        return exist, err
+    }
+    return i.mountBlob(digest.NewDigestFromEncoded(digest.SHA256, layerId))
+}
+
+// mountBlob asks the registry to link the blob from the MountFrom
+// repositories. Registries that cannot mount it open an upload session
+// instead, which is cancelled.
+func (i *Image) mountBlob(d digest.Digest) (bool, error) {
+    url := i.repositoryURL("blobs/uploads/")
+    for _, from := range i.MountFrom {
+        if from == i.repository() {
+            continue
+        }
+        resp, err := i.send(resty.MethodPost, url, func(req *resty.Request) *resty.Request {
+            return req.
+                SetQueryParam("mount", d.String()).
+                SetQueryParam("from", from)
+        })
+        if err != nil {
+            return false, err
+        }
+        switch resp.StatusCode() {
+        case http.StatusCreated:
+            log.Printf("blob: %s mounted from %s", d, from)
+            return true, nil
+        case http.StatusAccepted:
+            if location, _ := locationURL(resp); location != "" {
+                i.cancelUpload(location)
+            }
+        }
+    }
+    return false, nil
+}
+
+func readLocalManifest(source imageSource) (LocalManifest, error) {
+    manifests, err := readLocalManifests(source)
+    if err != nil {
+        return LocalManifest{}, err
+    }
+    return manifests[0], nil
+}
+
+func readLocalManifests(source imageSource) ([]LocalManifest, error) {
+    manifestFile, err := readSourceFile(source, "manifest.json")
+    if err != nil {
+        return nil, err
+    }
+    var manifests []LocalManifest
+    if err := json.Unmarshal(manifestFile, &manifests); err != nil {
+        return nil, err
+    }
+    if len(manifests) == 0 {
+        return nil, errors.New("no image found in manifest.json")
+    }
+    return manifests, nil
+}
+
+// rewriteRepoTags rewrites the RepoTags of each manifest below prefix. Tags
+// of different registries may end up on the same name, such as quay.io/a/b:1
+// and docker.io/a/b:1, which is an error rather than one overwriting the
+// other.
+func rewriteRepoTags(manifests []LocalManifest, prefix string) ([][]string, error) {
+    names := make([][]string, len(manifests))
+    sources := map[string]string{}
+    for index, manifest := range manifests {
+        for _, repoTag := range manifest.RepoTags {
+            name, err := rewriteRepoTag(repoTag, prefix)
+            if err != nil {
+                return nil, err
+            }
+            if source, ok := sources[name]; ok && source != repoTag {
+                return nil, fmt.Errorf("%s and %s would both be pushed as %s", source, repoTag, name)
+            }
+            sources[name] = repoTag
+            names[index] = append(names[index], name)
+        }
+    }
+    return names, nil
+}
+
+// rewriteRepoTag moves repoTag below prefix, keeping its repository path but
+// not its registry.
+func rewriteRepoTag(repoTag, prefix string) (string, error) {
+    if prefix == "" {
+        return repoTag, nil
+    }
+    ref, err := ParseReference(repoTag)
+    if err != nil {
+        return "", err
+    }
+    return fmt.Sprintf("%s:%s", path.Join(prefix, ref.Repository), ref.Tag), nil
+}
+
+func readConfigPlatform(source imageSource, configPath string) (*manifestlist.PlatformSpec, error) {
+    configFile, err := readSourceFile(source, configPath)
+    if err != nil {
+        return nil, err
+    }
+    return parseConfigPlatform(configFile, configPath)
+}
+
+// parseConfigPlatform reads the platform of an image config, name labels
+// the config in errors.
+func parseConfigPlatform(configFile []byte, name string) (*manifestlist.PlatformSpec, error) {
+    var config imageConfigPlatform
+    if err := json.Unmarshal(configFile, &config); err != nil {
+        return nil, err
+    }
+    if config.OS == "" || config.Architecture == "" {
+        return nil, fmt.Errorf("no platform found in %s", name)
+    }
+    return &manifestlist.PlatformSpec{
+        Architecture: config.Architecture,
+        OS:           config.OS,
+        OSVersion:    config.OSVersion,
+        OSFeatures:   config.OSFeatures,
+        Variant:      config.Variant,
+    }, nil
+}
+
+func containsDigest(digests []digest.Digest, d digest.Digest) bool {
+    for _, item := range digests {
+        if item == d {
+            return true
+        }
+    }
+    return false
+}
@@ -0,0 +1,73 @@
+package core
+
+import (
+    "fmt"
+    "path"
+
+    "github.com/docker/distribution/reference"
+    "github.com/opencontainers/go-digest"
+)
+
+const (
+    defaultRegistry = "registry-1.docker.io"
+    defaultTag      = "latest"
+)
+
+// Reference is a parsed image reference of the form
+// [registry[:port]/]path/to/repository[:tag][@digest].
+type Reference struct {
+    Registry   string
+    Repository string
+    Tag        string
+    Digest     digest.Digest
+}
+
+// ParseReference parses s following the docker reference grammar. Short
+// names are normalized the same way docker does (busybox resolves to
+// docker.io/library/busybox) and a reference without tag or digest gets
+// the "latest" tag.
+func ParseReference(s string) (*Reference, error) {
+    named, err := reference.ParseNormalizedNamed(s)
+    if err != nil {
+        return nil, fmt.Errorf("error image format: %q: %v", s, err)
+    }
+    ref := Reference{
+        Registry:   reference.Domain(named),
+        Repository: reference.Path(named),
+    }
+    if tagged, ok := named.(reference.Tagged); ok {
+        ref.Tag = tagged.Tag()
+    }
+    if digested, ok := named.(reference.Digested); ok {
+        ref.Digest = digested.Digest()
+    }
+    if ref.Tag == "" && ref.Digest == "" {
+        ref.Tag = defaultTag
+    }
+    return &ref, nil
+}
+
+// Repo returns the repository path without its last component.
+func (r *Reference) Repo() string {
+    repo := path.Dir(r.Repository)
+    if repo == "." {
+        return ""
+    }
+    return repo
+}
+
+// Name returns the last component of the repository path.
+func (r *Reference) Name() string {
+    return path.Base(r.Repository)
+}
+
+func (r *Reference) String() string {
+    s := path.Join(r.Registry, r.Repository)
+    if r.Tag != "" {
+        s += ":" + r.Tag
+    }
+    if r.Digest != "" {
+        s += "@" + r.Digest.String()
+    }
+    return s
+}
@@ -0,0 +1,95 @@
+package core
+
+import (
+    "testing"
+
+    "github.com/opencontainers/go-digest"
+)
+
+func TestParseReference(t *testing.T) {
+    const sum = "sha256:e4c58958181a5925816faa528ce959e487632f4cfd192f8132f71b32df2744b4"
+    tests := []struct {
+        in   string
+        want Reference
+        repo string
+        name string
+        str  string
+    }{
+        {
+            in:   "busybox",
+            want: Reference{Registry: "docker.io", Repository: "library/busybox", Tag: "latest"},
+            repo: "library",
+            name: "busybox",
+            str:  "docker.io/library/busybox:latest",
+        },
+        {
+            in:   "nginx:1.19",
+            want: Reference{Registry: "docker.io", Repository: "library/nginx", Tag: "1.19"},
+            repo: "library",
+            name: "nginx",
+            str:  "docker.io/library/nginx:1.19",
+        },
+        {
+            in:   "ciiiii/nodocker",
+            want: Reference{Registry: "docker.io", Repository: "ciiiii/nodocker", Tag: "latest"},
+            repo: "ciiiii",
+            name: "nodocker",
+            str:  "docker.io/ciiiii/nodocker:latest",
+        },
+        {
+            in:   "localhost:5000/team/sub/app:v1",
+            want: Reference{Registry: "localhost:5000", Repository: "team/sub/app", Tag: "v1"},
+            repo: "team/sub",
+            name: "app",
+            str:  "localhost:5000/team/sub/app:v1",
+        },
+        {
+            in:   "registry.example.com/app@" + sum,
+            want: Reference{Registry: "registry.example.com", Repository: "app", Digest: digest.Digest(sum)},
+            repo: "",
+            name: "app",
+            str:  "registry.example.com/app@" + sum,
+        },
+        {
+            in:   "quay.io/a/b:1@" + sum,
+            want: Reference{Registry: "quay.io", Repository: "a/b", Tag: "1", Digest: digest.Digest(sum)},
+            repo: "a",
+            name: "b",
+            str:  "quay.io/a/b:1@" + sum,
+        },
+    }
+    for _, tt := range tests {
+        t.Run(tt.in, func(t *testing.T) {
+            got, err := ParseReference(tt.in)
+            if err != nil {
+                t.Fatalf("ParseReference(%q): %v", tt.in, err)
+            }
+            if *got != tt.want {
+                t.Errorf("ParseReference(%q) = %+v, want %+v", tt.in, *got, tt.want)
+            }
+            if repo := got.Repo(); repo != tt.repo {
+                t.Errorf("Repo() = %q, want %q", repo, tt.repo)
+            }
+            if name := got.Name(); name != tt.name {
+                t.Errorf("Name() = %q, want %q", name, tt.name)
+            }
+            if str := got.String(); str != tt.str {
+                t.Errorf("String() = %q, want %q", str, tt.str)
+            }
+        })
+    }
+}
+
+func TestParseReferenceInvalid(t *testing.T) {
+    for _, in := range []string{
+        "",
+        "UPPER/case",
+        "app:",
+        "app@sha256:short",
+        "registry.example.com/app:bad tag",
+    } {
+        if ref, err := ParseReference(in); err == nil {
+            t.Errorf("ParseReference(%q) = %+v, want an error", in, ref)
+        }
+    }
+}
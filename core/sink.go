@@ -0,0 +1,252 @@
+package core
+
+import (
+    "archive/tar"
+    "io"
+    "io/ioutil"
+    "os"
+    "path"
+    "path/filepath"
+    "strconv"
+    "sync"
+    "time"
+)
+
+// fileSink receives the files of a docker-save style image. Names are slash
+// separated and relative to the image root.
+type fileSink interface {
+    exists(name string) bool
+    writeFile(name string, content []byte) error
+    // create opens name for writing size bytes. A negative size means the
+    // size is not known in advance.
+    create(name string, size int64) (io.WriteCloser, error)
+    // concurrent reports whether several files may be written at the same
+    // time.
+    concurrent() bool
+}
+
+// dirSink writes files below a directory.
+type dirSink struct {
+    root string
+}
+
+func (s *dirSink) path(name string) string {
+    return filepath.Join(s.root, filepath.FromSlash(name))
+}
+
+func (s *dirSink) exists(name string) bool {
+    _, err := os.Stat(s.path(name))
+    return err == nil
+}
+
+func (s *dirSink) writeFile(name string, content []byte) error {
+    if err := os.MkdirAll(filepath.Dir(s.path(name)), 0755); err != nil {
+        return err
+    }
+    return ioutil.WriteFile(s.path(name), content, 0644)
+}
+
+func (s *dirSink) concurrent() bool {
+    return true
+}
+
+func (s *dirSink) create(name string, size int64) (io.WriteCloser, error) {
+    if err := os.MkdirAll(filepath.Dir(s.path(name)), 0755); err != nil {
+        return nil, err
+    }
+    return os.Create(s.path(name))
+}
+
+// tarSink streams files into a tar archive. Entries of unknown size are
+// staged in a temporary file first, since tar headers carry the size.
+type tarSink struct {
+    tw      *tar.Writer
+    written map[string]bool
+}
+
+func newTarSink(w io.Writer) *tarSink {
+    return &tarSink{
+        tw:      tar.NewWriter(w),
+        written: map[string]bool{},
+    }
+}
+
+func (s *tarSink) exists(name string) bool {
+    return s.written[name]
+}
+
+func (s *tarSink) writeHeader(name string, size int64) error {
+    dir := path.Dir(name)
+    if dir != "." && !s.written[dir+"/"] {
+        if err := s.tw.WriteHeader(&tar.Header{
+            Typeflag: tar.TypeDir,
+            Name:     dir + "/",
+            Mode:     0755,
+            ModTime:  time.Unix(0, 0),
+        }); err != nil {
+            return err
+        }
+        s.written[dir+"/"] = true
+    }
+    s.written[name] = true
+    return s.tw.WriteHeader(&tar.Header{
+        Typeflag: tar.TypeReg,
+        Name:     name,
+        Size:     size,
+        Mode:     0644,
+        ModTime:  time.Unix(0, 0),
+    })
+}
+
+func (s *tarSink) writeFile(name string, content []byte) error {
+    if err := s.writeHeader(name, int64(len(content))); err != nil {
+        return err
+    }
+    _, err := s.tw.Write(content)
+    return err
+}
+
+func (s *tarSink) create(name string, size int64) (io.WriteCloser, error) {
+    if size < 0 {
+        f, err := ioutil.TempFile("", "nodocker-")
+        if err != nil {
+            return nil, err
+        }
+        return &stagedEntry{File: f, sink: s, name: name}, nil
+    }
+    if err := s.writeHeader(name, size); err != nil {
+        return nil, err
+    }
+    return tarEntry{s.tw}, nil
+}
+
+// concurrent is false, entries follow each other in the archive.
+func (s *tarSink) concurrent() bool {
+    return false
+}
+
+// close finishes the archive without closing the underlying writer.
+func (s *tarSink) close() error {
+    return s.tw.Close()
+}
+
+type tarEntry struct {
+    io.Writer
+}
+
+// Close is a no-op, the tar writer reports short entries on the next header.
+func (tarEntry) Close() error {
+    return nil
+}
+
+type stagedEntry struct {
+    *os.File
+    sink *tarSink
+    name string
+}
+
+func (e *stagedEntry) Close() error {
+    defer func() {
+        _ = e.File.Close()
+        _ = os.Remove(e.File.Name())
+    }()
+    stat, err := e.File.Stat()
+    if err != nil {
+        return err
+    }
+    if _, err := e.File.Seek(0, io.SeekStart); err != nil {
+        return err
+    }
+    if err := e.sink.writeHeader(e.name, stat.Size()); err != nil {
+        return err
+    }
+    _, err = io.Copy(e.sink.tw, e.File)
+    return err
+}
+
+// orderedWriter writes files into a sink taking one file at a time, in the
+// order of names. The file whose turn it is may be written straight into
+// the sink; the others are staged and copied in once their turn comes.
+type orderedWriter struct {
+    sink    fileSink
+    staging *dirSink
+    names   []string
+
+    mu sync.Mutex
+    // next is the index of the file whose turn it is
+    next int
+    // writing is set while a file goes into the sink
+    writing bool
+    staged  map[int]bool
+}
+
+func newOrderedWriter(sink fileSink, staging *dirSink, names []string) *orderedWriter {
+    return &orderedWriter{
+        sink:    sink,
+        staging: staging,
+        names:   names,
+        staged:  map[int]bool{},
+    }
+}
+
+// stagingName is the name of the file index in the staging directory.
+func stagingName(index int) string {
+    return strconv.Itoa(index)
+}
+
+// write has fetch write the file index, either straight into the sink under
+// its name when its turn came, or into the staging directory.
+func (w *orderedWriter) write(index int, fetch func(sink fileSink, name string) error) error {
+    if w.claim(index) {
+        if err := fetch(w.sink, w.names[index]); err != nil {
+            return err
+        }
+        return w.done(index, true)
+    }
+    if err := fetch(w.staging, stagingName(index)); err != nil {
+        return err
+    }
+    return w.done(index, false)
+}
+
+// claim reports whether the file index may be written straight into the
+// sink, which is then reserved for it until done.
+func (w *orderedWriter) claim(index int) bool {
+    w.mu.Lock()
+    defer w.mu.Unlock()
+    if index != w.next || w.writing {
+        return false
+    }
+    w.writing = true
+    return true
+}
+
+// done records that the file index was written into the sink when claimed
+// is set, or staged otherwise, and copies in the staged files whose turn
+// came.
+func (w *orderedWriter) done(index int, claimed bool) error {
+    w.mu.Lock()
+    defer w.mu.Unlock()
+    if claimed {
+        w.writing = false
+        w.next++
+    } else {
+        w.staged[index] = true
+    }
+    for !w.writing && w.staged[w.next] {
+        current := w.next
+        w.writing = true
+        w.mu.Unlock()
+        file := w.staging.path(stagingName(current))
+        err := copyToSink(w.sink, file, w.names[current])
+        _ = os.Remove(file)
+        w.mu.Lock()
+        w.writing = false
+        if err != nil {
+            return err
+        }
+        delete(w.staged, current)
+        w.next++
+    }
+    return nil
+}
@@ -0,0 +1,122 @@
+package core
+
+import (
+    "archive/tar"
+    "bytes"
+    "fmt"
+    "io"
+    "io/ioutil"
+    "strings"
+    "testing"
+    "time"
+)
+
+// writeOrdered writes names into a tar archive through an orderedWriter on
+// parallelism workers, each file taking delay(index) to write.
+func writeOrdered(t *testing.T, names []string, parallelism int, delay func(index int) time.Duration) []byte {
+    t.Helper()
+    var buf bytes.Buffer
+    sink := newTarSink(&buf)
+    staging := &dirSink{root: t.TempDir()}
+    writer := newOrderedWriter(sink, staging, names)
+    image := &Image{Parallelism: parallelism}
+    err := image.parallel(len(names), func(image *Image, index int) error {
+        return writer.write(index, func(sink fileSink, name string) error {
+            w, err := sink.create(name, -1)
+            if err != nil {
+                return err
+            }
+            time.Sleep(delay(index))
+            if _, err := io.WriteString(w, "content of "+names[index]); err != nil {
+                _ = w.Close()
+                return err
+            }
+            return w.Close()
+        })
+    })
+    if err != nil {
+        t.Fatal(err)
+    }
+    if err := sink.close(); err != nil {
+        t.Fatal(err)
+    }
+    left, err := ioutil.ReadDir(staging.root)
+    if err != nil {
+        t.Fatal(err)
+    }
+    if len(left) != 0 {
+        t.Errorf("%d files left in the staging directory", len(left))
+    }
+    return buf.Bytes()
+}
+
+func TestOrderedWriter(t *testing.T) {
+    var names []string
+    for index := 0; index < 12; index++ {
+        names = append(names, fmt.Sprintf("layer%d/layer.tar", index))
+    }
+    tests := []struct {
+        name  string
+        delay func(index int) time.Duration
+    }{
+        {
+            name:  "no delay",
+            delay: func(int) time.Duration { return 0 },
+        },
+        {
+            name: "later files finish first",
+            delay: func(index int) time.Duration {
+                return time.Duration(len(names)-index) * time.Millisecond
+            },
+        },
+        {
+            name: "first file finishes last",
+            delay: func(index int) time.Duration {
+                if index == 0 {
+                    return 20 * time.Millisecond
+                }
+                return 0
+            },
+        },
+        {
+            name: "uneven",
+            delay: func(index int) time.Duration {
+                return time.Duration(index*7%5) * time.Millisecond
+            },
+        },
+    }
+    for _, tt := range tests {
+        t.Run(tt.name, func(t *testing.T) {
+            serial := writeOrdered(t, names, 1, tt.delay)
+            parallel := writeOrdered(t, names, 4, tt.delay)
+            if !bytes.Equal(serial, parallel) {
+                t.Error("archives written with parallelism 1 and 4 differ")
+            }
+            var got []string
+            tr := tar.NewReader(bytes.NewReader(parallel))
+            for {
+                header, err := tr.Next()
+                if err == io.EOF {
+                    break
+                }
+                if err != nil {
+                    t.Fatal(err)
+                }
+                if header.Typeflag != tar.TypeReg {
+                    continue
+                }
+                content, err := ioutil.ReadAll(tr)
+                if err != nil {
+                    t.Fatal(err)
+                }
+                if string(content) != "content of "+header.Name {
+                    t.Errorf("%s: content = %q", header.Name, content)
+                }
+                got = append(got, header.Name)
+            }
+            if strings.Join(got, ",") != strings.Join(names, ",") {
+                t.Errorf("entries = %v, want %v", got, names)
+            }
+        })
+    }
+}
@@ -0,0 +1,77 @@
+package core
+
+import (
+    "crypto/tls"
+    "crypto/x509"
+    "fmt"
+    "io/ioutil"
+    "os"
+    "path/filepath"
+    "strings"
+)
+
+// defaultCertsDir is where docker looks for per-registry certificates.
+const defaultCertsDir = "/etc/docker/certs.d"
+
+// tlsConfig returns the TLS configuration for connections to host, or nil
+// when neither its RegistryHost nor CertsDir configure anything for it.
+// Following docker, CertsDir/<host>/*.crt are CA certificates and each
+// *.cert is a client certificate with its key in the matching *.key.
+func (c *RegistryConfig) tlsConfig(host string) (*tls.Config, error) {
+    settings := c.Hosts[host]
+    var caFiles []string
+    var keyPairs [][2]string
+    if settings.CAFile != "" {
+        caFiles = append(caFiles, settings.CAFile)
+    }
+    if settings.CertFile != "" || settings.KeyFile != "" {
+        keyPairs = append(keyPairs, [2]string{settings.CertFile, settings.KeyFile})
+    }
+    if c.CertsDir != "" {
+        dir := filepath.Join(c.CertsDir, host)
+        files, err := ioutil.ReadDir(dir)
+        if err != nil && !os.IsNotExist(err) {
+            return nil, err
+        }
+        for _, f := range files {
+            name := filepath.Join(dir, f.Name())
+            switch filepath.Ext(name) {
+            case ".crt":
+                caFiles = append(caFiles, name)
+            case ".cert":
+                keyPairs = append(keyPairs, [2]string{name, strings.TrimSuffix(name, ".cert") + ".key"})
+            }
+        }
+    }
+    if len(caFiles) == 0 && len(keyPairs) == 0 && !settings.SkipVerify {
+        return nil, nil
+    }
+
+    config := tls.Config{
+        InsecureSkipVerify: settings.SkipVerify,
+    }
+    if len(caFiles) > 0 {
+        pool, err := x509.SystemCertPool()
+        if err != nil {
+            pool = x509.NewCertPool()
+        }
+        for _, file := range caFiles {
+            pem, err := ioutil.ReadFile(file)
+            if err != nil {
+                return nil, err
+            }
+            if !pool.AppendCertsFromPEM(pem) {
+                return nil, fmt.Errorf("no certificate found in %s", file)
+            }
+        }
+        config.RootCAs = pool
+    }
+    for _, pair := range keyPairs {
+        cert, err := tls.LoadX509KeyPair(pair[0], pair[1])
+        if err != nil {
+            return nil, fmt.Errorf("load client certificate %s: %v", pair[0], err)
+        }
+        config.Certificates = append(config.Certificates, cert)
+    }
+    return &config, nil
+}
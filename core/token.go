@@ -0,0 +1,313 @@
+package core
+
+import (
+    "encoding/json"
+    "errors"
+    "fmt"
+    "log"
+    "net/http"
+    "net/url"
+    "sort"
+    "strings"
+    "sync"
+    "time"
+)
+
+const (
+    // tokenClientID identifies this client to token servers.
+    tokenClientID = "nodocker"
+    // minTokenExpiry is the lifetime assumed by the token spec when the
+    // server does not send expires_in, or sends less.
+    minTokenExpiry = 60 * time.Second
+    // tokenRefreshMargin is how long before expiry a token is refreshed, so
+    // that it does not run out between being checked and being used.
+    tokenRefreshMargin = 15 * time.Second
+)
+
+// errOAuthNotSupported is returned when a token server does not implement
+// the POST OAuth2 flow.
+var errOAuthNotSupported = errors.New("token server does not support OAuth2")
+
+// tokenResponse is the body of a token server response; older servers send
+// token and newer ones access_token, often both.
+type tokenResponse struct {
+    Token        string `json:"token"`
+    AccessToken  string `json:"access_token"`
+    ExpiresIn    int    `json:"expires_in"`
+    IssuedAt     string `json:"issued_at"`
+    RefreshToken string `json:"refresh_token"`
+}
+
+func (t *tokenResponse) token() string {
+    if t.AccessToken != "" {
+        return t.AccessToken
+    }
+    return t.Token
+}
+
+// expiresAt trusts issued_at unless it is off far enough to point to clock
+// skew between us and the token server.
+func (t *tokenResponse) expiresAt() time.Time {
+    now := time.Now()
+    expiresIn := time.Duration(t.ExpiresIn) * time.Second
+    if expiresIn < minTokenExpiry {
+        expiresIn = minTokenExpiry
+    }
+    issuedAt, err := time.Parse(time.RFC3339, t.IssuedAt)
+    if err != nil || issuedAt.After(now) || now.Sub(issuedAt) > expiresIn {
+        issuedAt = now
+    }
+    return issuedAt.Add(expiresIn)
+}
+
+// fetchToken gets a bearer token for scopes from the realm of the registry.
+// A refresh token is exchanged with the OAuth2 refresh_token grant, a
+// password with the password grant, and servers without OAuth2 support get
+// the basic auth GET request. Refresh tokens handed out on the way are kept
+// in the token cache, so that later requests do not need the password; the
+// account is left as it is.
+func (i *Image) fetchToken(scopes ...string) (*tokenResponse, error) {
+    var token *tokenResponse
+    var err error
+    if refreshToken := i.tokens.refreshToken(i.AuthInfo); refreshToken != "" {
+        token, err = i.postToken(url.Values{
+            "grant_type":    {"refresh_token"},
+            "refresh_token": {refreshToken},
+        }, scopes)
+        if err != nil {
+            // the refresh token may have been revoked, fall back to the
+            // account
+            log.Printf("refresh token for %s rejected: %v", i.AuthInfo.Realm, err)
+            i.tokens.putRefreshToken(i.AuthInfo, "")
+            token = nil
+        }
+    }
+    if token == nil {
+        switch {
+        case i.Account != nil && i.Account.IdentityToken != "":
+            token, err = i.postToken(url.Values{
+                "grant_type":    {"refresh_token"},
+                "refresh_token": {i.Account.IdentityToken},
+            }, scopes)
+        case i.Account != nil && i.Account.Username != "":
+            token, err = i.postToken(url.Values{
+                "grant_type": {"password"},
+                "username":   {i.Account.Username},
+                "password":   {i.Account.Password},
+            }, scopes)
+            if err == errOAuthNotSupported {
+                token, err = i.getToken(scopes)
+            }
+        default:
+            token, err = i.getToken(scopes)
+        }
+    }
+    if err != nil {
+        return nil, err
+    }
+    if token.token() == "" {
+        return nil, fmt.Errorf("no token returned by %q", i.AuthInfo.Realm)
+    }
+    if token.RefreshToken != "" {
+        i.tokens.putRefreshToken(i.AuthInfo, token.RefreshToken)
+    }
+    return token, nil
+}
+
+func (i *Image) postToken(form url.Values, scopes []string) (*tokenResponse, error) {
+    form.Set("client_id", tokenClientID)
+    form.Set("access_type", "offline")
+    if i.AuthInfo.Service != "" {
+        form.Set("service", i.AuthInfo.Service)
+    }
+    if len(scopes) > 0 {
+        form.Set("scope", strings.Join(scopes, " "))
+    }
+    resp, err := i.Client.R().
+        SetFormDataFromValues(form).
+        Post(i.AuthInfo.Realm)
+    if err != nil {
+        return nil, err
+    }
+    switch resp.StatusCode() {
+    case http.StatusOK:
+    case http.StatusNotFound, http.StatusMethodNotAllowed:
+        if form.Get("grant_type") == "password" {
+            return nil, errOAuthNotSupported
+        }
+        fallthrough
+    default:
+        return nil, fmt.Errorf("post token to %q failed\ncode: %d\nbody:%s", i.AuthInfo.Realm, resp.StatusCode(), resp.Body())
+    }
+    var token tokenResponse
+    if err := json.Unmarshal(resp.Body(), &token); err != nil {
+        return nil, err
+    }
+    return &token, nil
+}
+
+func (i *Image) getToken(scopes []string) (*tokenResponse, error) {
+    query := url.Values{"scope": scopes}
+    if i.AuthInfo.Service != "" {
+        query.Set("service", i.AuthInfo.Service)
+    }
+    req := i.Client.R()
+    if i.Account != nil && i.Account.Username != "" {
+        query.Set("account", i.Account.Username)
+        query.Set("client_id", tokenClientID)
+        query.Set("offline_token", "true")
+        req = req.SetBasicAuth(i.Account.Username, i.Account.Password)
+    }
+    resp, err := req.
+        SetQueryParamsFromValues(query).
+        Get(i.AuthInfo.Realm)
+    if err != nil {
+        return nil, err
+    }
+    if resp.StatusCode() != http.StatusOK {
+        return nil, fmt.Errorf("get token from %q failed\ncode: %d\nbody:%s", i.AuthInfo.Realm, resp.StatusCode(), resp.Body())
+    }
+    var token tokenResponse
+    if err := json.Unmarshal(resp.Body(), &token); err != nil {
+        return nil, err
+    }
+    return &token, nil
+}
+
+type tokenKey struct {
+    realm   string
+    service string
+    scope   string
+}
+
+// refreshKey identifies the token server a refresh token is for.
+type refreshKey struct {
+    realm   string
+    service string
+}
+
+type cachedToken struct {
+    token     string
+    expiresAt time.Time
+}
+
+// tokenCache keeps bearer tokens until shortly before they expire, along
+// with the refresh tokens of each token server. It is shared by the images
+// of one account, a nil cache keeps nothing.
+type tokenCache struct {
+    mu            sync.Mutex
+    tokens        map[tokenKey]cachedToken
+    refreshTokens map[refreshKey]string
+    // fetching serializes token requests, so that parallel transfers
+    // needing a token share the one fetched first.
+    fetching sync.Mutex
+}
+
+func newTokenCache() *tokenCache {
+    return &tokenCache{
+        tokens:        map[tokenKey]cachedToken{},
+        refreshTokens: map[refreshKey]string{},
+    }
+}
+
+func newTokenKey(auth RegistryAuth, scopes []string) tokenKey {
+    sorted := append([]string(nil), scopes...)
+    sort.Strings(sorted)
+    return tokenKey{
+        realm:   auth.Realm,
+        service: auth.Service,
+        scope:   strings.Join(sorted, " "),
+    }
+}
+
+func (c *tokenCache) get(key tokenKey) (cachedToken, bool) {
+    if c == nil {
+        return cachedToken{}, false
+    }
+    c.mu.Lock()
+    defer c.mu.Unlock()
+    token, ok := c.tokens[key]
+    if !ok || time.Until(token.expiresAt) < tokenRefreshMargin {
+        delete(c.tokens, key)
+        return cachedToken{}, false
+    }
+    return token, true
+}
+
+// refreshToken returns the refresh token handed out by the token server of
+// auth, if any.
+func (c *tokenCache) refreshToken(auth RegistryAuth) string {
+    if c == nil {
+        return ""
+    }
+    c.mu.Lock()
+    defer c.mu.Unlock()
+    return c.refreshTokens[refreshKey{realm: auth.Realm, service: auth.Service}]
+}
+
+// putRefreshToken stores token for the token server of auth, an empty token
+// drops it.
+func (c *tokenCache) putRefreshToken(auth RegistryAuth, token string) {
+    if c == nil {
+        return
+    }
+    c.mu.Lock()
+    defer c.mu.Unlock()
+    key := refreshKey{realm: auth.Realm, service: auth.Service}
+    if token == "" {
+        delete(c.refreshTokens, key)
+        return
+    }
+    c.refreshTokens[key] = token
+}
+
+// lockFetch holds fetching until the returned function is called.
+func (c *tokenCache) lockFetch() func() {
+    if c == nil {
+        return func() {}
+    }
+    c.fetching.Lock()
+    return c.fetching.Unlock
+}
+
+func (c *tokenCache) put(key tokenKey, token cachedToken) {
+    if c == nil {
+        return
+    }
+    c.mu.Lock()
+    defer c.mu.Unlock()
+    c.tokens[key] = token
+}
+
+// refreshToken makes sure AuthInfo carries a bearer token for the current
+// scopes that does not expire soon, from the cache unless force is set.
+func (i *Image) refreshToken(force bool) error {
+    if i.AuthInfo.Scheme != authSchemeBearer || len(i.authScopes) == 0 {
+        return nil
+    }
+    if !force && i.AuthInfo.Token != "" && time.Until(i.AuthInfo.ExpiresAt) >= tokenRefreshMargin {
+        return nil
+    }
+    key := newTokenKey(i.AuthInfo, i.authScopes)
+    token, ok := i.tokens.get(key)
+    if force || !ok {
+        unlock := i.tokens.lockFetch()
+        defer unlock()
+        // another transfer may have fetched a new token while we waited
+        token, ok = i.tokens.get(key)
+        if !ok || (force && token.token == i.AuthInfo.Token) {
+            response, err := i.fetchToken(i.authScopes...)
+            if err != nil {
+                return err
+            }
+            token = cachedToken{
+                token:     response.token(),
+                expiresAt: response.expiresAt(),
+            }
+            i.tokens.put(key, token)
+        }
+    }
+    i.AuthInfo.Token = token.token
+    i.AuthInfo.ExpiresAt = token.expiresAt
+    return nil
+}
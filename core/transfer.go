@@ -0,0 +1,66 @@
+package core
+
+import (
+    "context"
+    "sync"
+)
+
+// defaultParallelism is how many blobs are transferred at the same time
+// unless Image.Parallelism says otherwise, as docker's default.
+const defaultParallelism = 3
+
+// parallel runs task for the indexes 0 to n-1 on up to Parallelism workers.
+// Each worker works on its own copy of i, so that refreshing tokens does not
+// race; tasks store their results by index, which keeps them in order. The
+// first error cancels the tasks not started yet as well as the requests in
+// flight, and is returned.
+func (i *Image) parallel(n int, task func(image *Image, index int) error) error {
+    workers := i.Parallelism
+    if workers < 1 {
+        workers = 1
+    }
+    if workers > n {
+        workers = n
+    }
+    parent := i.ctx
+    if parent == nil {
+        parent = context.Background()
+    }
+    ctx, cancel := context.WithCancel(parent)
+    defer cancel()
+
+    var once sync.Once
+    var firstErr error
+    var wg sync.WaitGroup
+    indexes := make(chan int)
+    for w := 0; w < workers; w++ {
+        image := *i
+        image.ctx = ctx
+        wg.Add(1)
+        go func() {
+            defer wg.Done()
+            for index := range indexes {
+                if err := task(&image, index); err != nil {
+                    once.Do(func() {
+                        firstErr = err
+                        cancel()
+                    })
+                }
+            }
+        }()
+    }
+feed:
+    for index := 0; index < n; index++ {
+        select {
+        case indexes <- index:
+        case <-ctx.Done():
+            break feed
+        }
+    }
+    close(indexes)
+    wg.Wait()
+    if firstErr == nil {
+        return parent.Err()
+    }
+    return firstErr
+}
@@ -1,5 +1,28 @@
 package core
 
+import "github.com/opencontainers/go-digest"
+
+// ManifestFormat selects the media types of the manifests built by Push.
+type ManifestFormat int
+
+const (
+    // ManifestFormatDocker builds docker schema2 manifests and manifest lists.
+    ManifestFormatDocker ManifestFormat = iota
+    // ManifestFormatOCI builds OCI image manifests and indexes.
+    ManifestFormatOCI
+)
+
+// OutputFormat selects how Pull writes images to disk.
+type OutputFormat int
+
+const (
+    // OutputFormatDocker writes a docker-save style directory under TargetPath.
+    OutputFormatDocker OutputFormat = iota
+    // OutputFormatOCI adds the image to an OCI image layout rooted at the
+    // pull directory, so that images pulled into it share their blobs.
+    OutputFormatOCI
+)
+
 type ManifestV1 struct {
     SchemaVersion int    `json:"schemaVersion"`
     Name          string `json:"name"`
@@ -23,3 +46,17 @@ type LocalManifest struct {
     RepoTags []string `json:"repoTags"`
     Layers []string `json:"Layers"`
 }
+
+type manifestBlob struct {
+    mediaType string
+    digest    digest.Digest
+    content   []byte
+}
+
+type imageConfigPlatform struct {
+    Architecture string   `json:"architecture"`
+    OS           string   `json:"os"`
+    OSVersion    string   `json:"os.version,omitempty"`
+    OSFeatures   []string `json:"os.features,omitempty"`
+    Variant      string   `json:"variant,omitempty"`
+}
@@ -0,0 +1,192 @@
+package core
+
+import (
+    "fmt"
+    "log"
+    "net/http"
+    "strconv"
+    "strings"
+
+    "github.com/go-resty/resty/v2"
+    "github.com/opencontainers/go-digest"
+)
+
+// uploadRetries is how many times a chunk is resumed after a failure.
+const uploadRetries = 3
+
+// uploadSession is a blob upload in progress. offset counts the bytes the
+// registry acknowledged, url is the upload location to send the next
+// request to.
+type uploadSession struct {
+    image  *Image
+    url    string
+    offset int64
+}
+
+func (i *Image) startUpload() (*uploadSession, error) {
+    url, err := i.prepareUploading()
+    if err != nil {
+        return nil, err
+    }
+    return &uploadSession{image: i, url: url}, nil
+}
+
+// contentRange formats the inclusive byte range of length bytes at start.
+func contentRange(start, length int64) string {
+    return fmt.Sprintf("%d-%d", start, start+length-1)
+}
+
+// parseRange returns the offset following the range of a Range header such
+// as 0-1023. Registries report an empty upload as 0-0 as well, which is
+// read as nothing received so that no byte gets lost.
+func parseRange(header string) (int64, bool) {
+    header = strings.TrimPrefix(header, "bytes=")
+    parts := strings.SplitN(header, "-", 2)
+    if len(parts) != 2 {
+        return 0, false
+    }
+    start, err := strconv.ParseInt(parts[0], 10, 64)
+    if err != nil {
+        return 0, false
+    }
+    end, err := strconv.ParseInt(parts[1], 10, 64)
+    if err != nil || end < start {
+        return 0, false
+    }
+    if end == 0 {
+        return 0, true
+    }
+    return end + 1, true
+}
+
+// retriableStatus reports whether an upload request failing with code may
+// succeed when resumed.
+func retriableStatus(code int) bool {
+    switch code {
+    case http.StatusRequestTimeout, http.StatusRequestedRangeNotSatisfiable, http.StatusTooManyRequests:
+        return true
+    }
+    return code >= http.StatusInternalServerError
+}
+
+// update takes the location and the acknowledged range out of resp.
+func (s *uploadSession) update(resp *resty.Response, fallbackOffset int64) error {
+    location, err := locationURL(resp)
+    if err != nil {
+        return err
+    }
+    if location != "" {
+        s.url = location
+    }
+    if offset, ok := parseRange(resp.Header().Get("Range")); ok {
+        s.offset = offset
+    } else {
+        s.offset = fallbackOffset
+    }
+    return nil
+}
+
+// status asks the registry how much of the upload it received.
+func (s *uploadSession) status() error {
+    resp, err := s.image.send(resty.MethodGet, s.url, func(req *resty.Request) *resty.Request {
+        return req
+    })
+    if err != nil {
+        return err
+    }
+    if resp.StatusCode() != http.StatusNoContent {
+        return fmt.Errorf("upload status error\ncode: %d\nbody:%s", resp.StatusCode(), resp.Body())
+    }
+    return s.update(resp, s.offset)
+}
+
+// resume queries the upload status after err and checks that the registry
+// stands within chunk, which starts at start, so that the rest of it can be
+// sent again.
+func (s *uploadSession) resume(err error, attempt int, start int64, chunk []byte) error {
+    if attempt >= uploadRetries {
+        return err
+    }
+    log.Printf("upload interrupted at %d: %v, resuming", s.offset, err)
+    if statusErr := s.status(); statusErr != nil {
+        return fmt.Errorf("%v, and the upload status is unknown: %v", err, statusErr)
+    }
+    if s.offset < start || s.offset > start+int64(len(chunk)) {
+        return fmt.Errorf("%v, and the registry stands at %d outside of the chunk at %d", err, s.offset, start)
+    }
+    return nil
+}
+
+// patch sends chunk, which follows the acknowledged offset, resuming from
+// the last acknowledged byte when a request fails.
+func (s *uploadSession) patch(chunk []byte) error {
+    start := s.offset
+    end := start + int64(len(chunk))
+    for attempt := 0; s.offset < end; attempt++ {
+        rest, before := chunk[s.offset-start:], s.offset
+        resp, err := s.image.send(resty.MethodPatch, s.url, func(req *resty.Request) *resty.Request {
+            return req.
+                SetHeader("Content-Type", "application/octet-stream").
+                SetHeader("Content-Range", contentRange(s.offset, int64(len(rest)))).
+                SetBody(rest)
+        })
+        if err == nil && resp.StatusCode() != http.StatusAccepted {
+            err = fmt.Errorf("PATCH chunk error\ncode: %d\nbody:%s", resp.StatusCode(), resp.Body())
+            if !retriableStatus(resp.StatusCode()) {
+                return err
+            }
+        }
+        if err == nil {
+            err = s.update(resp, end)
+        }
+        if err == nil && s.offset <= before {
+            err = fmt.Errorf("registry acknowledged nothing of the chunk at %d", before)
+        }
+        if err != nil {
+            if err := s.resume(err, attempt, start, chunk); err != nil {
+                return err
+            }
+        }
+    }
+    return nil
+}
+
+// commit sends the last chunk along with the digest of the blob. A commit
+// whose response got lost is detected by the blob being present.
+func (s *uploadSession) commit(d digest.Digest, chunk []byte) error {
+    start := s.offset
+    for attempt := 0; ; attempt++ {
+        rest := chunk[s.offset-start:]
+        resp, err := s.image.send(resty.MethodPut, s.url, func(req *resty.Request) *resty.Request {
+            req = req.
+                SetHeader("Content-Type", "application/octet-stream").
+                SetQueryParam("digest", d.String()).
+                SetBody(rest)
+            if len(rest) > 0 {
+                req = req.SetHeader("Content-Range", contentRange(s.offset, int64(len(rest))))
+            }
+            return req
+        })
+        if err == nil {
+            if resp.StatusCode() == http.StatusCreated {
+                return nil
+            }
+            err = fmt.Errorf("PUT chunk error\ncode: %d\nbody:%s", resp.StatusCode(), resp.Body())
+            if !retriableStatus(resp.StatusCode()) {
+                return err
+            }
+        }
+        if exist, existErr := s.image.checkLayerExist(d.Encoded()); existErr == nil && exist {
+            return nil
+        }
+        if err := s.resume(err, attempt, start, chunk); err != nil {
+            return err
+        }
+    }
+}
+
+// cancel drops the upload, ignoring failures since registries expire
+// unfinished uploads anyway.
+func (s *uploadSession) cancel() {
+    s.image.cancelUpload(s.url)
+}
@@ -0,0 +1,66 @@
+package core
+
+import (
+    "net/http"
+    "testing"
+)
+
+func TestContentRange(t *testing.T) {
+    tests := []struct {
+        start, length int64
+        want          string
+    }{
+        {0, 1, "0-0"},
+        {0, 2097152, "0-2097151"},
+        {2097152, 10, "2097152-2097161"},
+    }
+    for _, tt := range tests {
+        if got := contentRange(tt.start, tt.length); got != tt.want {
+            t.Errorf("contentRange(%d, %d) = %q, want %q", tt.start, tt.length, got, tt.want)
+        }
+    }
+}
+
+func TestParseRange(t *testing.T) {
+    tests := []struct {
+        header string
+        offset int64
+        ok     bool
+    }{
+        // an empty upload and a single received byte look the same, the
+        // byte is sent again rather than lost
+        {"0-0", 0, true},
+        {"0-1", 2, true},
+        {"0-2097151", 2097152, true},
+        {"bytes=0-99", 100, true},
+        {"5-9", 10, true},
+        {"", 0, false},
+        {"0", 0, false},
+        {"a-b", 0, false},
+        {"0-x", 0, false},
+        {"9-5", 0, false},
+    }
+    for _, tt := range tests {
+        offset, ok := parseRange(tt.header)
+        if offset != tt.offset || ok != tt.ok {
+            t.Errorf("parseRange(%q) = %d, %v, want %d, %v", tt.header, offset, ok, tt.offset, tt.ok)
+        }
+    }
+}
+
+func TestRetriableStatus(t *testing.T) {
+    for code, want := range map[int]bool{
+        http.StatusRequestTimeout:               true,
+        http.StatusRequestedRangeNotSatisfiable: true,
+        http.StatusTooManyRequests:              true,
+        http.StatusInternalServerError:          true,
+        http.StatusBadGateway:                   true,
+        http.StatusBadRequest:                   false,
+        http.StatusUnauthorized:                 false,
+        http.StatusNotFound:                     false,
+    } {
+        if got := retriableStatus(code); got != want {
+            t.Errorf("retriableStatus(%d) = %v, want %v", code, got, want)
+        }
+    }
+}
@@ -1,15 +1,19 @@
 package core
 
 import (
+    "bytes"
     "crypto/sha256"
     "encoding/hex"
-    "errors"
+    "encoding/json"
     "fmt"
     "io"
-    "os"
-    "regexp"
-    "strings"
+    "mime"
     "text/template"
+
+    "github.com/docker/distribution/manifest/manifestlist"
+    "github.com/docker/distribution/manifest/schema2"
+    "github.com/opencontainers/go-digest"
+    v1 "github.com/opencontainers/image-spec/specs-go/v1"
 )
 
 const (
@@ -43,39 +47,84 @@ const (
 }`
 )
 
+// mediaTypeImageLayerZstd is missing from the vendored image-spec release.
+const mediaTypeImageLayerZstd = "application/vnd.oci.image.layer.v1.tar+zstd"
+
 var acceptHeaders = []string{
     "application/vnd.docker.distribution.manifest.v2+json",
     "application/vnd.docker.distribution.manifest.list.v2+json",
+    v1.MediaTypeImageManifest,
+    v1.MediaTypeImageIndex,
     "application/vnd.docker.distribution.manifest.v1+prettyjws",
     "application/json",
 }
 
-func parseTag(s string) (string, string, error) {
-    colonSplitStr := strings.Split(s, ":")
-    switch len(colonSplitStr) {
-    case 1:
-        return s, "latest", nil
-    case 2:
-        return colonSplitStr[0], colonSplitStr[1], nil
+// manifestMediaType returns the media type of a manifest response. Registries
+// serving it as plain json get the mediaType field of the manifest instead.
+func manifestMediaType(contentType string, content []byte) string {
+    mediaType, _, err := mime.ParseMediaType(contentType)
+    if err == nil && mediaType != "application/json" && mediaType != "text/plain" {
+        return mediaType
+    }
+    var versioned struct {
+        MediaType string          `json:"mediaType"`
+        Manifests json.RawMessage `json:"manifests"`
+        Config    json.RawMessage `json:"config"`
+    }
+    if err := json.Unmarshal(content, &versioned); err != nil {
+        return contentType
+    }
+    switch {
+    case versioned.MediaType != "":
+        return versioned.MediaType
+    case versioned.Manifests != nil:
+        return v1.MediaTypeImageIndex
+    case versioned.Config != nil:
+        return v1.MediaTypeImageManifest
     default:
-        return "", "", errors.New(fmt.Sprintf("error image format: %q", s))
+        return contentType
     }
 }
 
-func matchAuthUrls(s string) (*RegistryAuth, error) {
-    regex, err := regexp.Compile(`"(.*?)"`)
-    if err != nil {
-        return nil, err
+// layerMediaType picks the layer media type of format matching the
+// compression of content. Docker has no zstd layer type, so the OCI one is
+// used for both formats.
+func layerMediaType(format ManifestFormat, content []byte) string {
+    switch {
+    case bytes.HasPrefix(content, []byte{0x1f, 0x8b}):
+        if format == ManifestFormatOCI {
+            return v1.MediaTypeImageLayerGzip
+        }
+        return schema2.MediaTypeLayer
+    case bytes.HasPrefix(content, []byte{0x28, 0xb5, 0x2f, 0xfd}):
+        return mediaTypeImageLayerZstd
+    case format == ManifestFormatOCI:
+        return v1.MediaTypeImageLayer
+    default:
+        return schema2.MediaTypeUncompressedLayer
     }
-    matchStrings := regex.FindAllString(s, -1)
-    if len(matchStrings) != 2 {
-        return nil, fmt.Errorf("get realm and service from header %s failed", s)
+}
+
+func isImageManifest(mediaType string) bool {
+    return mediaType == schema2.MediaTypeManifest || mediaType == v1.MediaTypeImageManifest
+}
+
+func isManifestList(mediaType string) bool {
+    return mediaType == manifestlist.MediaTypeManifestList || mediaType == v1.MediaTypeImageIndex
+}
+
+func verifyContent(expected digest.Digest, content []byte) error {
+    if err := expected.Validate(); err != nil {
+        return err
     }
-    return &RegistryAuth{
-        Realm:   strings.ReplaceAll(matchStrings[0], "\"", ""),
-        Service: strings.ReplaceAll(matchStrings[1], "\"", ""),
-        Token:   "",
-    }, nil
+    verifier := expected.Verifier()
+    if _, err := verifier.Write(content); err != nil {
+        return err
+    }
+    if !verifier.Verified() {
+        return fmt.Errorf("digest mismatch: expected %s, got %s", expected, expected.Algorithm().FromBytes(content))
+    }
+    return nil
 }
 
 func hashSha256(s string) string {
@@ -94,12 +143,3 @@ func layerJsonTemplate(id, parentId string, writer io.Writer) error {
         "parent": parentId,
     })
 }
-
-func getFileSize(file string) int64 {
-    f, _ := os.Open(file)
-    stat, _ := f.Stat()
-    defer func() {
-        _ = f.Close()
-    }()
-    return stat.Size()
-}
@@ -0,0 +1,68 @@
+package core
+
+import (
+    "fmt"
+
+    "github.com/opencontainers/go-digest"
+)
+
+// BlobMismatchError is returned when a downloaded blob does not match the
+// digest or size it is referenced with.
+type BlobMismatchError struct {
+    Digest digest.Digest
+    // Size is the expected size, negative when the reference does not
+    // record it.
+    Size int64
+    // Received is how many bytes were received.
+    Received int64
+}
+
+func (e *BlobMismatchError) Error() string {
+    if e.Size >= 0 && e.Received != e.Size {
+        return fmt.Sprintf("blob %s: size mismatch: expected %d bytes, received %d", e.Digest, e.Size, e.Received)
+    }
+    return fmt.Sprintf("blob %s: digest mismatch over %d bytes", e.Digest, e.Received)
+}
+
+// blobVerifier checks the content written to it against a digest and, when
+// known, a size. Writes fail as soon as the content outgrows the size, so
+// that an oversized blob is not downloaded to the end.
+type blobVerifier struct {
+    digest   digest.Digest
+    size     int64
+    verifier digest.Verifier
+    written  int64
+}
+
+func newBlobVerifier(d digest.Digest, size int64) *blobVerifier {
+    return &blobVerifier{
+        digest:   d,
+        size:     size,
+        verifier: d.Verifier(),
+    }
+}
+
+func (v *blobVerifier) Write(p []byte) (int, error) {
+    v.written += int64(len(p))
+    if v.size >= 0 && v.written > v.size {
+        return 0, v.mismatch()
+    }
+    return v.verifier.Write(p)
+}
+
+func (v *blobVerifier) mismatch() error {
+    return &BlobMismatchError{
+        Digest:   v.digest,
+        Size:     v.size,
+        Received: v.written,
+    }
+}
+
+// verify returns a *BlobMismatchError unless the content written so far is
+// the whole blob.
+func (v *blobVerifier) verify() error {
+    if v.size >= 0 && v.written != v.size || !v.verifier.Verified() {
+        return v.mismatch()
+    }
+    return nil
+}
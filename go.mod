@@ -6,6 +6,6 @@ require (
 	github.com/docker/distribution v2.7.1+incompatible
 	github.com/go-resty/resty/v2 v2.3.0
 	github.com/opencontainers/go-digest v1.0.0
-	github.com/opencontainers/image-spec v1.0.1 // indirect
+	github.com/opencontainers/image-spec v1.0.1
 	golang.org/x/net v0.0.0-20200813134508-3edf25e44fcc // indirect
 )